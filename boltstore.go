@@ -0,0 +1,223 @@
+package sessions
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var boltBucket = []byte("sessions")
+
+var errBoltStoreClosed = errors.New("sessions: BoltStore is closed")
+
+// boltCompactTxSize bounds the bytes copied per transaction while compacting
+const boltCompactTxSize = 1 << 20
+
+// BoltStore keeps sessions in a bbolt file so they survive restarts. Every
+// value is prefixed with its expiry in unix nanoseconds, 0 for none. Expired
+// entries are hidden from Get and removed by GC. bbolt reuses the pages they
+// leave behind but never shrinks the file, so GC also compacts it once at
+// least half of it is free.
+type BoltStore struct {
+	path string
+	// mu guards db, Compact swaps in a new file under the write lock
+	mu      sync.RWMutex
+	db      *bolt.DB
+	clock   Clock
+	janitor *janitor
+}
+
+func openBolt(path string) (*bolt.DB, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+func NewBoltStore(path string, opts ...StoreOption) (*BoltStore, error) {
+	db, err := openBolt(path)
+	if err != nil {
+		return nil, err
+	}
+	o := newStoreOptions(opts)
+	bs := &BoltStore{
+		path:  path,
+		db:    db,
+		clock: o.clock,
+	}
+	bs.janitor = startJanitor(o, bs.GC)
+	return bs, nil
+}
+
+// Close stops the janitor before closing the file, bbolt waits for running
+// transactions and every committed one is already synced to disk
+func (bs *BoltStore) Close() error {
+	bs.janitor.Stop()
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	if bs.db == nil {
+		return nil
+	}
+	err := bs.db.Close()
+	bs.db = nil
+	return err
+}
+
+func (bs *BoltStore) view(fn func(tx *bolt.Tx) error) error {
+	bs.mu.RLock()
+	defer bs.mu.RUnlock()
+	if bs.db == nil {
+		return errBoltStoreClosed
+	}
+	return bs.db.View(fn)
+}
+
+func (bs *BoltStore) update(fn func(tx *bolt.Tx) error) error {
+	bs.mu.RLock()
+	defer bs.mu.RUnlock()
+	if bs.db == nil {
+		return errBoltStoreClosed
+	}
+	return bs.db.Update(fn)
+}
+
+func (bs *BoltStore) expired(v []byte, now time.Time) bool {
+	if len(v) < 8 {
+		return true
+	}
+	expires := int64(binary.BigEndian.Uint64(v))
+	return expires != 0 && expires <= now.UnixNano()
+}
+
+func (bs *BoltStore) GC() {
+	now := bs.clock.Now()
+	bs.update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltBucket)
+		// deleting under a cursor makes it skip entries, so collect first
+		var keys [][]byte
+		b.ForEach(func(k, v []byte) error {
+			if bs.expired(v, now) {
+				keys = append(keys, append([]byte{}, k...))
+			}
+			return nil
+		})
+		for _, k := range keys {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if bs.sparse() {
+		bs.Compact()
+	}
+}
+
+// sparse reports whether at least half of the file is free pages
+func (bs *BoltStore) sparse() bool {
+	sparse := false
+	bs.view(func(tx *bolt.Tx) error {
+		db := tx.DB()
+		free := int64(db.Stats().FreePageN) * int64(db.Info().PageSize)
+		sparse = 0 < free && tx.Size() <= 2*free
+		return nil
+	})
+	return sparse
+}
+
+// Compact copies the sessions into a fresh file and swaps it in, requests
+// wait for it to finish
+func (bs *BoltStore) Compact() error {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	if bs.db == nil {
+		return errBoltStoreClosed
+	}
+	tmp := bs.path + ".compact"
+	os.Remove(tmp)
+	dst, err := bolt.Open(tmp, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+	err = bolt.Compact(dst, bs.db, boltCompactTxSize)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := bs.db.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	// reopen whichever file is in place, the old one when the rename failed
+	err = os.Rename(tmp, bs.path)
+	if err != nil {
+		os.Remove(tmp)
+	}
+	db, oerr := openBolt(bs.path)
+	if oerr != nil {
+		bs.db = nil
+		return oerr
+	}
+	bs.db = db
+	return err
+}
+
+func (bs *BoltStore) Len() int {
+	n := 0
+	bs.view(func(tx *bolt.Tx) error {
+		n = tx.Bucket(boltBucket).Stats().KeyN
+		return nil
+	})
+	return n
+}
+
+func (bs *BoltStore) Get(key string) ([]byte, error) {
+	var b []byte
+	err := bs.view(func(tx *bolt.Tx) error {
+		v := tx.Bucket(boltBucket).Get([]byte(key))
+		if v == nil || bs.expired(v, bs.clock.Now()) {
+			return nil
+		}
+		// v is only valid during the transaction
+		b = append([]byte{}, v[8:]...)
+		return nil
+	})
+	return b, err
+}
+
+func (bs *BoltStore) Set(key string, val []byte) error {
+	return bs.SetWithTTL(key, val, 0)
+}
+
+func (bs *BoltStore) SetWithTTL(key string, val []byte, ttl time.Duration) error {
+	v := make([]byte, 8+len(val))
+	if 0 < ttl {
+		binary.BigEndian.PutUint64(v, uint64(bs.clock.Now().Add(ttl).UnixNano()))
+	}
+	copy(v[8:], val)
+	return bs.update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Put([]byte(key), v)
+	})
+}
+
+func (bs *BoltStore) Del(key string) error {
+	return bs.update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Delete([]byte(key))
+	})
+}
@@ -0,0 +1,131 @@
+package sessions_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mix3/fever-sessions"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBoltStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sessions.db")
+	fc := newFakeClock()
+	bs, err := sessions.NewBoltStore(path, sessions.WithClock(fc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs.Set("hoge", []byte("fuga"))
+	{
+		v, _ := bs.Get("hoge")
+		assert.Equal(t, []byte("fuga"), v)
+	}
+	bs.Del("hoge")
+	{
+		v, err := bs.Get("hoge")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte(nil), v)
+	}
+	bs.SetWithTTL("foo", []byte("bar"), time.Minute)
+	bs.Set("baz", []byte("qux"))
+	assert.NoError(t, bs.Close())
+	assert.NoError(t, bs.Close())
+
+	// values survive reopening the file
+	bs, err = sessions.NewBoltStore(path, sessions.WithClock(fc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+	{
+		v, _ := bs.Get("foo")
+		assert.Equal(t, []byte("bar"), v)
+		v, _ = bs.Get("baz")
+		assert.Equal(t, []byte("qux"), v)
+	}
+	fc.Add(time.Minute)
+	{
+		v, _ := bs.Get("foo")
+		assert.Equal(t, []byte(nil), v)
+	}
+}
+
+func TestBoltStoreGC(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	clock := newFakeClock()
+	bs, err := sessions.NewBoltStore(filepath.Join(dir, "sessions.db"), sessions.WithGCInterval(time.Minute), sessions.WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// values without a ttl carry a zero expiry prefix and stay
+	bs.SetWithTTL("hoge", []byte("hoge"), time.Minute)
+	bs.Set("piyo", []byte("piyo"))
+	clock.Sweep(2 * time.Minute)
+	assert.Equal(t, 1, bs.Len())
+	{
+		v, _ := bs.Get("piyo")
+		assert.Equal(t, []byte("piyo"), v)
+	}
+
+	assert.NoError(t, bs.Close())
+	_, err = bs.Get("piyo")
+	assert.Error(t, err)
+}
+
+func TestBoltStoreCompact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sessions.db")
+	clock := newFakeClock()
+	bs, err := sessions.NewBoltStore(path, sessions.WithGCInterval(time.Minute), sessions.WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+	size := func() int64 {
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fi.Size()
+	}
+	val := make([]byte, 4096)
+	for i := 0; i < 500; i++ {
+		bs.SetWithTTL(fmt.Sprintf("key%d", i), val, time.Minute)
+	}
+	bs.Set("keep", []byte("keep"))
+	before := size()
+
+	clock.Sweep(2 * time.Minute)
+	assert.Equal(t, 1, bs.Len())
+	assert.True(t, size() < before/4, "%d bytes before, %d after", before, size())
+	{
+		v, err := bs.Get("keep")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("keep"), v)
+	}
+	// the store keeps working on the new file
+	bs.Set("more", []byte("more"))
+	{
+		v, _ := bs.Get("more")
+		assert.Equal(t, []byte("more"), v)
+	}
+	assert.NoError(t, bs.Compact())
+	assert.Equal(t, 2, bs.Len())
+}
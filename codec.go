@@ -0,0 +1,66 @@
+package sessions
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// GobCodec is the default, every stored type has to be gob.Register'ed
+type GobCodec struct{}
+
+func (GobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	err := enc.Encode(v)
+	if err != nil {
+		return []byte{}, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (GobCodec) Unmarshal(data []byte, v interface{}) error {
+	dec := gob.NewDecoder(bytes.NewBuffer(data))
+	return dec.Decode(v)
+}
+
+// JSONCodec decodes numbers as float64 and objects as map[string]interface{}
+type JSONCodec struct{}
+
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+type MsgpackCodec struct{}
+
+func (MsgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	return msgpack.Marshal(v)
+}
+
+func (MsgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	return msgpack.Unmarshal(data, v)
+}
+
+// marshalValue encodes a single session value. It goes through a pointer to
+// an interface so gob records the concrete type and unmarshalValue gets it
+// back.
+func marshalValue(codec Codec, v interface{}) ([]byte, error) {
+	return codec.Marshal(&v)
+}
+
+func unmarshalValue(codec Codec, data []byte) (interface{}, error) {
+	var v interface{}
+	err := codec.Unmarshal(data, &v)
+	return v, err
+}
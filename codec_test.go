@@ -0,0 +1,86 @@
+package sessions_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/mix3/fever-sessions"
+	"github.com/mix3/fever/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCodec(t *testing.T) {
+	for name, codec := range map[string]sessions.Codec{
+		"gob":     sessions.GobCodec{},
+		"json":    sessions.JSONCodec{},
+		"msgpack": sessions.MsgpackCodec{},
+	} {
+		b, err := codec.Marshal(map[string]interface{}{
+			"username": "foo",
+			"_flash":   []interface{}{"hoge", "fuga"},
+		})
+		if !assert.NoError(t, err, name) {
+			continue
+		}
+		var v map[string]interface{}
+		if !assert.NoError(t, codec.Unmarshal(b, &v), name) {
+			continue
+		}
+		assert.Equal(t, "foo", v["username"], name)
+		assert.Equal(t, []interface{}{"hoge", "fuga"}, v["_flash"], name)
+	}
+}
+
+func TestSessionsCodec(t *testing.T) {
+	for name, codec := range map[string]sessions.Codec{
+		"default": nil,
+		"json":    sessions.JSONCodec{},
+		"msgpack": sessions.MsgpackCodec{},
+	} {
+		store := sessions.NewMemoryStore()
+		ss := sessions.New(store, "myapp_session")
+		ss.Codec = codec
+		m := mux.New()
+		m.Use(ss.Middleware)
+		m.Get("/").ThenFunc(func(c context.Context, w http.ResponseWriter, r *http.Request) {
+			s := sessions.Session(c)
+			if flashes := s.Flashes(); 0 < len(flashes) {
+				fmt.Fprintf(w, "%s %v %v", s.Get("username"), flashes[0], flashes[1])
+			} else {
+				s.Set("username", "foo")
+				s.AddFlash("hoge")
+				s.AddFlash("fuga")
+				fmt.Fprintf(w, "AddFlash")
+			}
+		})
+		ts := httptest.NewServer(m)
+		c := newClient(t)
+		re := regexp.MustCompile("myapp_session=([a-f0-9]{40})")
+		var sid string
+		{
+			_, body, header := c.Get(t, ts.URL, "myapp_session")
+			assert.Equal(t, "AddFlash", body, name)
+			if ok := assert.Len(t, header["Set-Cookie"], 1, name); ok {
+				sid = re.FindStringSubmatch(header["Set-Cookie"][0])[1]
+			}
+		}
+		if name == "json" {
+			b, _ := store.Get(sid)
+			var v map[string]interface{}
+			assert.NoError(t, json.Unmarshal(b, &v))
+			assert.Equal(t, "foo", v["username"])
+		}
+		{
+			_, body, _ := c.Get(t, ts.URL, "myapp_session")
+			assert.Equal(t, "foo hoge fuga", body, name)
+		}
+		ts.Close()
+		store.Close()
+	}
+}
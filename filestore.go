@@ -0,0 +1,164 @@
+package sessions
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var ErrUnsafeKey = errors.New("sessions: key is not safe as a file name")
+
+// keys become file names, so no separators, no leading dot and no ".."
+var fileKeyPattern = regexp.MustCompile(`\A[A-Za-z0-9_\-][A-Za-z0-9_.\-]{0,199}\z`)
+
+const fileTempPrefix = ".tmp-"
+
+// FileStore keeps every session in a file of its own under dir, spread over
+// 256 subdirectories. Like PHP's session files a session lives for maxAge
+// after it was last written, judged by the file mtime, and zero keeps files
+// forever. Keys that are unsafe as file names are never touched, Get reports
+// them as missing and Set and Del fail with ErrUnsafeKey.
+type FileStore struct {
+	dir     string
+	maxAge  time.Duration
+	clock   Clock
+	janitor *janitor
+}
+
+func NewFileStore(dir string, maxAge time.Duration, opts ...StoreOption) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	o := newStoreOptions(opts)
+	fs := &FileStore{
+		dir:    dir,
+		maxAge: maxAge,
+		clock:  o.clock,
+	}
+	fs.janitor = startJanitor(o, fs.GC)
+	return fs, nil
+}
+
+func (fs *FileStore) Close() error {
+	fs.janitor.Stop()
+	return nil
+}
+
+func (fs *FileStore) shard(key string) string {
+	return filepath.Join(fs.dir, fmt.Sprintf("%02x", crc32.ChecksumIEEE([]byte(key))&0xff))
+}
+
+func (fs *FileStore) path(key string) (string, bool) {
+	if !fileKeyPattern.MatchString(key) || strings.Contains(key, "..") {
+		return "", false
+	}
+	return filepath.Join(fs.shard(key), key), true
+}
+
+func (fs *FileStore) stale(mtime time.Time, now time.Time) bool {
+	return 0 < fs.maxAge && fs.maxAge <= now.Sub(mtime)
+}
+
+// GC removes session files and leftover temp files older than maxAge
+func (fs *FileStore) GC() {
+	if fs.maxAge <= 0 {
+		return
+	}
+	now := fs.clock.Now()
+	shards, err := ioutil.ReadDir(fs.dir)
+	if err != nil {
+		return
+	}
+	for _, shard := range shards {
+		if !shard.IsDir() {
+			continue
+		}
+		dir := filepath.Join(fs.dir, shard.Name())
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, fi := range files {
+			if fi.Mode().IsRegular() && fs.stale(fi.ModTime(), now) {
+				os.Remove(filepath.Join(dir, fi.Name()))
+			}
+		}
+	}
+}
+
+func (fs *FileStore) Get(key string) ([]byte, error) {
+	path, ok := fs.path(key)
+	if !ok {
+		return []byte(nil), nil
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []byte(nil), nil
+		}
+		return nil, err
+	}
+	if fs.stale(fi.ModTime(), fs.clock.Now()) {
+		return []byte(nil), nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		// removed by GC in the meantime
+		return []byte(nil), nil
+	}
+	return b, err
+}
+
+// Set writes a temp file next to the session file and renames it into place,
+// so readers see either the old or the new session
+func (fs *FileStore) Set(key string, val []byte) error {
+	path, ok := fs.path(key)
+	if !ok {
+		return ErrUnsafeKey
+	}
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, fileTempPrefix)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(val)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		now := fs.clock.Now()
+		err = os.Chtimes(f.Name(), now, now)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+func (fs *FileStore) Del(key string) error {
+	path, ok := fs.path(key)
+	if !ok {
+		return ErrUnsafeKey
+	}
+	err := os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
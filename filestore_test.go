@@ -0,0 +1,125 @@
+package sessions_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mix3/fever-sessions"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fc := newFakeClock()
+	fs, err := sessions.NewFileStore(dir, time.Hour, sessions.WithClock(fc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	fs.Set("hoge", []byte("fuga"))
+	{
+		v, _ := fs.Get("hoge")
+		assert.Equal(t, []byte("fuga"), v)
+		matches, _ := filepath.Glob(filepath.Join(dir, "*", "hoge"))
+		assert.Len(t, matches, 1)
+		temps, _ := filepath.Glob(filepath.Join(dir, "*", ".tmp-*"))
+		assert.Len(t, temps, 0)
+	}
+	fs.Set("hoge", []byte("piyo"))
+	{
+		v, _ := fs.Get("hoge")
+		assert.Equal(t, []byte("piyo"), v)
+	}
+	fs.Del("hoge")
+	{
+		v, err := fs.Get("hoge")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte(nil), v)
+		assert.NoError(t, fs.Del("hoge"))
+	}
+	fs.Set("foo", []byte("bar"))
+	fc.Add(59 * time.Minute)
+	{
+		v, _ := fs.Get("foo")
+		assert.Equal(t, []byte("bar"), v)
+	}
+	fc.Add(time.Minute)
+	{
+		v, _ := fs.Get("foo")
+		assert.Equal(t, []byte(nil), v)
+	}
+}
+
+func TestFileStoreUnsafeKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs, err := sessions.NewFileStore(filepath.Join(dir, "store"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	ioutil.WriteFile(filepath.Join(dir, "secret"), []byte("secret"), 0600)
+	for _, key := range []string{"", ".", "..", "../secret", "../../secret", "a/b", `a\b`, ".hidden", "a..b", "a\x00b"} {
+		v, err := fs.Get(key)
+		assert.NoError(t, err, key)
+		assert.Equal(t, []byte(nil), v, key)
+		assert.Equal(t, sessions.ErrUnsafeKey, fs.Set(key, []byte("x")), key)
+		assert.Equal(t, sessions.ErrUnsafeKey, fs.Del(key), key)
+	}
+	b, _ := ioutil.ReadFile(filepath.Join(dir, "secret"))
+	assert.Equal(t, []byte("secret"), b)
+	assert.NoError(t, fs.Set("example.com_0123abcd", []byte("x")))
+}
+
+func TestFileStoreGC(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	clock := newFakeClock()
+	fs, err := sessions.NewFileStore(dir, time.Hour, sessions.WithGCInterval(time.Minute), sessions.WithClock(clock))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exists := func(path string) bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}
+	fs.Set("hoge", []byte("hoge"))
+	fs.Set("fuga", []byte("fuga"))
+	// a temp file left behind by a crash during Set
+	matches, _ := filepath.Glob(filepath.Join(dir, "*", "hoge"))
+	if len(matches) != 1 {
+		t.Fatal("hoge was not written")
+	}
+	leftover := filepath.Join(filepath.Dir(matches[0]), ".tmp-123")
+	ioutil.WriteFile(leftover, []byte("hoge"), 0600)
+	os.Chtimes(leftover, clock.Now(), clock.Now())
+
+	// a rewrite renews the mtime the age is judged by
+	clock.Add(30 * time.Minute)
+	fs.Set("hoge", []byte("hoge"))
+	clock.Sweep(30 * time.Minute)
+	assert.True(t, exists(matches[0]))
+	assert.False(t, exists(leftover))
+	{
+		v, _ := fs.Get("fuga")
+		assert.Equal(t, []byte(nil), v)
+		matches, _ := filepath.Glob(filepath.Join(dir, "*", "fuga"))
+		assert.Len(t, matches, 0)
+	}
+
+	assert.NoError(t, fs.Close())
+	assert.NoError(t, fs.Close())
+}
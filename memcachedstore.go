@@ -0,0 +1,385 @@
+package sessions
+
+import (
+	"bufio"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errMemcachedKey    = errors.New("sessions: key is not a valid memcached key")
+	errMemcachedClosed = errors.New("sessions: MemcachedStore is closed")
+)
+
+// expirations beyond 30 days are taken as unix times by memcached
+const memcachedRelativeLimit = 30 * 24 * time.Hour
+
+// memcachedMaxItemSize is the default item size limit of memcached, longer
+// values announced by a server are not trusted
+const memcachedMaxItemSize = 1 << 20
+
+// points per server on the hash ring, enough to spread keys evenly
+const memcachedReplicas = 160
+
+// MemcachedStorableFlag is F_STORABLE of Perl's Cache::Memcached::Fast, which
+// only thaws values carrying it. Set it as Flags when Perl reads sessions
+// written with StorableCodec.
+const MemcachedStorableFlag uint32 = 1
+
+// memcachedError is an error line sent by the server, the connection stays usable
+type memcachedError string
+
+func (e memcachedError) Error() string {
+	return "sessions: memcached: " + string(e)
+}
+
+type memcachedConn struct {
+	nc net.Conn
+	rw *bufio.ReadWriter
+}
+
+type memcachedServer struct {
+	network string
+	address string
+
+	mu     sync.Mutex
+	idle   []*memcachedConn
+	closed bool
+}
+
+func (s *memcachedServer) get(timeout time.Duration) (*memcachedConn, error) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil, errMemcachedClosed
+	}
+	if n := len(s.idle); 0 < n {
+		c := s.idle[n-1]
+		s.idle = s.idle[:n-1]
+		s.mu.Unlock()
+		return c, nil
+	}
+	s.mu.Unlock()
+	nc, err := net.DialTimeout(s.network, s.address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &memcachedConn{
+		nc: nc,
+		rw: bufio.NewReadWriter(bufio.NewReader(nc), bufio.NewWriter(nc)),
+	}, nil
+}
+
+func (s *memcachedServer) put(c *memcachedConn, maxIdle int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed || maxIdle <= len(s.idle) {
+		c.nc.Close()
+		return
+	}
+	s.idle = append(s.idle, c)
+}
+
+func (s *memcachedServer) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.idle {
+		c.nc.Close()
+	}
+	s.idle = nil
+	s.closed = true
+}
+
+// memcachedHash places servers and keys on the ring, md5 like ketama since
+// crc32 clusters similar strings
+func memcachedHash(s string) uint32 {
+	sum := md5.Sum([]byte(s))
+	return binary.LittleEndian.Uint32(sum[:4])
+}
+
+type memcachedPoint struct {
+	hash   uint32
+	server *memcachedServer
+}
+
+// MemcachedStore keeps sessions in memcached, spread over the servers by
+// consistent hashing so adding or removing one only moves its share of keys.
+// Addresses containing a slash are dialed as unix sockets.
+type MemcachedStore struct {
+	servers []*memcachedServer
+	ring    []memcachedPoint
+	Prefix  string
+	// Timeout bounds dialing and every command, MaxIdle is per server
+	Timeout time.Duration
+	MaxIdle int
+	// Flags are stored with every value
+	Flags uint32
+	// Clock turns ttls beyond 30 days into unix times, nil means time.Now
+	Clock Clock
+}
+
+func NewMemcachedStore(addresses ...string) (*MemcachedStore, error) {
+	if len(addresses) == 0 {
+		return nil, wrapError(ErrInvalidConfig, errors.New("no memcached servers"))
+	}
+	ms := &MemcachedStore{
+		Timeout: time.Second,
+		MaxIdle: 2,
+	}
+	for _, address := range addresses {
+		s := &memcachedServer{network: "tcp", address: address}
+		if strings.Contains(address, "/") {
+			s.network = "unix"
+		}
+		ms.servers = append(ms.servers, s)
+		for i := 0; i < memcachedReplicas; i++ {
+			ms.ring = append(ms.ring, memcachedPoint{
+				hash:   memcachedHash(address + "-" + strconv.Itoa(i)),
+				server: s,
+			})
+		}
+	}
+	sort.Slice(ms.ring, func(i, j int) bool {
+		return ms.ring[i].hash < ms.ring[j].hash
+	})
+	return ms, nil
+}
+
+func (ms *MemcachedStore) Close() error {
+	for _, s := range ms.servers {
+		s.close()
+	}
+	return nil
+}
+
+func (ms *MemcachedStore) key(key string) (string, bool) {
+	k := ms.Prefix + key
+	if len(k) == 0 || 250 < len(k) {
+		return "", false
+	}
+	for i := 0; i < len(k); i++ {
+		if k[i] <= ' ' || k[i] == 0x7f {
+			return "", false
+		}
+	}
+	return k, true
+}
+
+func (ms *MemcachedStore) server(key string) *memcachedServer {
+	h := memcachedHash(key)
+	i := sort.Search(len(ms.ring), func(i int) bool {
+		return h <= ms.ring[i].hash
+	})
+	if i == len(ms.ring) {
+		i = 0
+	}
+	return ms.ring[i].server
+}
+
+func (ms *MemcachedStore) do(key string, fn func(rw *bufio.ReadWriter) error) error {
+	s := ms.server(key)
+	c, err := s.get(ms.Timeout)
+	if err != nil {
+		return err
+	}
+	if 0 < ms.Timeout {
+		c.nc.SetDeadline(time.Now().Add(ms.Timeout))
+	}
+	err = fn(c.rw)
+	if _, ok := err.(memcachedError); err != nil && !ok {
+		// the reply may be half read
+		c.nc.Close()
+		return err
+	}
+	s.put(c, ms.MaxIdle)
+	return err
+}
+
+func readMemcachedLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r"), nil
+}
+
+func memcachedReplyError(line string) error {
+	if line == "ERROR" || strings.HasPrefix(line, "CLIENT_ERROR ") || strings.HasPrefix(line, "SERVER_ERROR ") {
+		return memcachedError(line)
+	}
+	return fmt.Errorf("sessions: unexpected memcached reply %q", line)
+}
+
+// readMemcachedValue reads the reply to get or gets, val is nil for a missing key
+func readMemcachedValue(r *bufio.Reader) (val []byte, cas uint64, err error) {
+	line, err := readMemcachedLine(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	if line == "END" {
+		return nil, 0, nil
+	}
+	fields := strings.Fields(line)
+	if len(fields) < 4 || fields[0] != "VALUE" {
+		return nil, 0, memcachedReplyError(line)
+	}
+	n, err := strconv.Atoi(fields[3])
+	if err != nil || n < 0 || memcachedMaxItemSize < n {
+		return nil, 0, fmt.Errorf("sessions: unexpected memcached reply %q", line)
+	}
+	if 4 < len(fields) {
+		cas, err = strconv.ParseUint(fields[4], 10, 64)
+		if err != nil {
+			return nil, 0, fmt.Errorf("sessions: unexpected memcached reply %q", line)
+		}
+	}
+	val = make([]byte, n+2)
+	if _, err := io.ReadFull(r, val); err != nil {
+		return nil, 0, err
+	}
+	if string(val[n:]) != "\r\n" {
+		return nil, 0, errors.New("sessions: corrupt memcached value")
+	}
+	line, err = readMemcachedLine(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	if line != "END" {
+		return nil, 0, memcachedReplyError(line)
+	}
+	return val[:n], cas, nil
+}
+
+func (ms *MemcachedStore) retrieve(cmd, key string) ([]byte, uint64, error) {
+	k, ok := ms.key(key)
+	if !ok {
+		return []byte(nil), 0, nil
+	}
+	var val []byte
+	var cas uint64
+	err := ms.do(k, func(rw *bufio.ReadWriter) error {
+		fmt.Fprintf(rw, "%s %s\r\n", cmd, k)
+		if err := rw.Flush(); err != nil {
+			return err
+		}
+		var err error
+		val, cas, err = readMemcachedValue(rw.Reader)
+		return err
+	})
+	return val, cas, err
+}
+
+// exptime converts ttl into whole seconds, or into a unix time when
+// memcached would not take it as relative
+func (ms *MemcachedStore) exptime(ttl time.Duration) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+	sec := ttlSeconds(ttl)
+	if memcachedRelativeLimit < ttl {
+		now := time.Now()
+		if ms.Clock != nil {
+			now = ms.Clock.Now()
+		}
+		return now.Unix() + sec
+	}
+	return sec
+}
+
+// store sends set, add or cas and reports whether the value was stored
+func (ms *MemcachedStore) store(cmd, key string, val []byte, ttl time.Duration, cas uint64) (bool, error) {
+	k, ok := ms.key(key)
+	if !ok {
+		return false, errMemcachedKey
+	}
+	var stored bool
+	err := ms.do(k, func(rw *bufio.ReadWriter) error {
+		fmt.Fprintf(rw, "%s %s %d %d %d", cmd, k, ms.Flags, ms.exptime(ttl), len(val))
+		if cmd == "cas" {
+			fmt.Fprintf(rw, " %d", cas)
+		}
+		rw.WriteString("\r\n")
+		rw.Write(val)
+		rw.WriteString("\r\n")
+		if err := rw.Flush(); err != nil {
+			return err
+		}
+		line, err := readMemcachedLine(rw.Reader)
+		if err != nil {
+			return err
+		}
+		switch line {
+		case "STORED":
+			stored = true
+		case "NOT_STORED", "EXISTS", "NOT_FOUND":
+		default:
+			return memcachedReplyError(line)
+		}
+		return nil
+	})
+	return stored, err
+}
+
+func (ms *MemcachedStore) Get(key string) ([]byte, error) {
+	val, _, err := ms.retrieve("get", key)
+	return val, err
+}
+
+func (ms *MemcachedStore) Set(key string, val []byte) error {
+	return ms.SetWithTTL(key, val, 0)
+}
+
+func (ms *MemcachedStore) SetWithTTL(key string, val []byte, ttl time.Duration) error {
+	_, err := ms.store("set", key, val, ttl, 0)
+	return err
+}
+
+// GetVersion uses the cas unique of the item as its version
+func (ms *MemcachedStore) GetVersion(key string) ([]byte, string, error) {
+	val, cas, err := ms.retrieve("gets", key)
+	if err != nil || val == nil {
+		return val, "", err
+	}
+	return val, strconv.FormatUint(cas, 10), nil
+}
+
+func (ms *MemcachedStore) CompareAndSet(key string, val []byte, version string, ttl time.Duration) (bool, error) {
+	if version == "" {
+		return ms.store("add", key, val, ttl, 0)
+	}
+	cas, err := strconv.ParseUint(version, 10, 64)
+	if err != nil {
+		return false, nil
+	}
+	return ms.store("cas", key, val, ttl, cas)
+}
+
+func (ms *MemcachedStore) Del(key string) error {
+	k, ok := ms.key(key)
+	if !ok {
+		return errMemcachedKey
+	}
+	return ms.do(k, func(rw *bufio.ReadWriter) error {
+		fmt.Fprintf(rw, "delete %s\r\n", k)
+		if err := rw.Flush(); err != nil {
+			return err
+		}
+		line, err := readMemcachedLine(rw.Reader)
+		if err != nil {
+			return err
+		}
+		if line != "DELETED" && line != "NOT_FOUND" {
+			return memcachedReplyError(line)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,39 @@
+package sessions
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemcachedStoreHashing(t *testing.T) {
+	// the ring only depends on the addresses, nothing is dialed
+	addrs := []string{"10.0.0.1:11211", "10.0.0.2:11211", "10.0.0.3:11211"}
+	ms, err := NewMemcachedStore(addrs...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spread := map[string]int{}
+	for i := 0; i < 300; i++ {
+		spread[ms.server(fmt.Sprintf("key%d", i)).address]++
+	}
+	for _, addr := range addrs {
+		assert.True(t, 50 < spread[addr], "uneven spread %v", spread)
+	}
+
+	// dropping a server only moves the keys it held
+	fewer, err := NewMemcachedStore(addrs[:2]...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 300; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if addr := ms.server(key).address; addr != addrs[2] {
+			assert.Equal(t, addr, fewer.server(key).address, key)
+		}
+	}
+
+	_, err = NewMemcachedStore()
+	assert.Error(t, err)
+}
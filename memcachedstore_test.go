@@ -0,0 +1,279 @@
+package sessions_test
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mix3/fever-sessions"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeMemcachedItem struct {
+	val     []byte
+	flags   string
+	cas     uint64
+	exptime int64
+	expires time.Time
+}
+
+// fakeMemcached speaks enough of the memcached text protocol for MemcachedStore
+type fakeMemcached struct {
+	sync.Mutex
+	ln    net.Listener
+	items map[string]fakeMemcachedItem
+	cas   uint64
+}
+
+func newFakeMemcached(t *testing.T) *fakeMemcached {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fm := &fakeMemcached{ln: ln, items: map[string]fakeMemcachedItem{}}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go fm.serve(c)
+		}
+	}()
+	return fm
+}
+
+func (fm *fakeMemcached) Addr() string {
+	return fm.ln.Addr().String()
+}
+
+func (fm *fakeMemcached) Close() {
+	fm.ln.Close()
+}
+
+func (fm *fakeMemcached) Len() int {
+	fm.Lock()
+	defer fm.Unlock()
+	return len(fm.items)
+}
+
+func (fm *fakeMemcached) Exptime(key string) int64 {
+	fm.Lock()
+	defer fm.Unlock()
+	return fm.items[key].exptime
+}
+
+func (fm *fakeMemcached) Flags(key string) string {
+	fm.Lock()
+	defer fm.Unlock()
+	return fm.items[key].flags
+}
+
+func (fm *fakeMemcached) get(key string) (fakeMemcachedItem, bool) {
+	item, ok := fm.items[key]
+	if ok && !item.expires.IsZero() && !time.Now().Before(item.expires) {
+		delete(fm.items, key)
+		return item, false
+	}
+	return item, ok
+}
+
+func (fm *fakeMemcached) serve(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	w := bufio.NewWriter(c)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		fm.Lock()
+		switch cmd := fields[0]; cmd {
+		case "get", "gets":
+			for _, k := range fields[1:] {
+				if item, ok := fm.get(k); ok {
+					if cmd == "gets" {
+						fmt.Fprintf(w, "VALUE %s %s %d %d\r\n", k, item.flags, len(item.val), item.cas)
+					} else {
+						fmt.Fprintf(w, "VALUE %s %s %d\r\n", k, item.flags, len(item.val))
+					}
+					w.Write(item.val)
+					w.WriteString("\r\n")
+				}
+			}
+			w.WriteString("END\r\n")
+		case "set", "add", "cas":
+			exptime, _ := strconv.ParseInt(fields[3], 10, 64)
+			n, _ := strconv.Atoi(fields[4])
+			val := make([]byte, n+2)
+			if _, err := io.ReadFull(r, val); err != nil {
+				fm.Unlock()
+				return
+			}
+			item, exists := fm.get(fields[1])
+			switch {
+			case cmd == "add" && exists:
+				w.WriteString("NOT_STORED\r\n")
+			case cmd == "cas" && !exists:
+				w.WriteString("NOT_FOUND\r\n")
+			case cmd == "cas" && fields[5] != strconv.FormatUint(item.cas, 10):
+				w.WriteString("EXISTS\r\n")
+			default:
+				fm.cas++
+				item = fakeMemcachedItem{val: val[:n], flags: fields[2], cas: fm.cas, exptime: exptime}
+				if 30*24*60*60 < exptime {
+					item.expires = time.Unix(exptime, 0)
+				} else if 0 < exptime {
+					item.expires = time.Now().Add(time.Duration(exptime) * time.Second)
+				}
+				fm.items[fields[1]] = item
+				w.WriteString("STORED\r\n")
+			}
+		case "delete":
+			if _, ok := fm.get(fields[1]); ok {
+				delete(fm.items, fields[1])
+				w.WriteString("DELETED\r\n")
+			} else {
+				w.WriteString("NOT_FOUND\r\n")
+			}
+		default:
+			w.WriteString("ERROR\r\n")
+		}
+		fm.Unlock()
+		if err := w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func TestMemcachedStore(t *testing.T) {
+	fm := newFakeMemcached(t)
+	defer fm.Close()
+	ms, err := sessions.NewMemcachedStore(fm.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ms.Close()
+	ms.Prefix = "myapp:"
+	ms.Set("hoge", []byte("fuga"))
+	{
+		v, _ := ms.Get("hoge")
+		assert.Equal(t, []byte("fuga"), v)
+		assert.Equal(t, 1, fm.Len())
+	}
+	ms.Del("hoge")
+	{
+		v, err := ms.Get("hoge")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte(nil), v)
+		assert.NoError(t, ms.Del("hoge"))
+	}
+	ms.SetWithTTL("foo", []byte("bar\r\nEND\r\n"), 1500*time.Millisecond)
+	{
+		v, _ := ms.Get("foo")
+		assert.Equal(t, []byte("bar\r\nEND\r\n"), v)
+		assert.Equal(t, int64(2), fm.Exptime("myapp:foo"))
+	}
+	clock := newFakeClock()
+	ms.Clock = clock
+	ms.SetWithTTL("foo", []byte("bar"), 60*24*time.Hour)
+	{
+		assert.Equal(t, clock.Now().Add(60*24*time.Hour).Unix(), fm.Exptime("myapp:foo"))
+		assert.Equal(t, "0", fm.Flags("myapp:foo"))
+	}
+	ms.Flags = sessions.MemcachedStorableFlag
+	ms.Set("foo", []byte("bar"))
+	{
+		v, _ := ms.Get("foo")
+		assert.Equal(t, []byte("bar"), v)
+		assert.Equal(t, "1", fm.Flags("myapp:foo"))
+	}
+	{
+		assert.Error(t, ms.Set("with space", []byte("x")))
+		assert.Error(t, ms.Set(strings.Repeat("x", 300), []byte("x")))
+		v, err := ms.Get("with space")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte(nil), v)
+	}
+}
+
+func TestMemcachedStoreCompareAndSet(t *testing.T) {
+	fm := newFakeMemcached(t)
+	defer fm.Close()
+	ms, err := sessions.NewMemcachedStore(fm.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ms.Close()
+	var _ sessions.VersionedStore = ms
+	{
+		ok, err := ms.CompareAndSet("hoge", []byte("fuga"), "", 0)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	}
+	v, version, _ := ms.GetVersion("hoge")
+	assert.Equal(t, []byte("fuga"), v)
+	assert.NotEqual(t, "", version)
+	{
+		ok, _ := ms.CompareAndSet("hoge", []byte("piyo"), "", 0)
+		assert.False(t, ok)
+	}
+	ms.Set("hoge", []byte("foo"))
+	{
+		ok, _ := ms.CompareAndSet("hoge", []byte("piyo"), version, 0)
+		assert.False(t, ok)
+		v, _ := ms.Get("hoge")
+		assert.Equal(t, []byte("foo"), v)
+	}
+	_, version, _ = ms.GetVersion("hoge")
+	{
+		ok, err := ms.CompareAndSet("hoge", []byte("piyo"), version, time.Hour)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		v, _ := ms.Get("hoge")
+		assert.Equal(t, []byte("piyo"), v)
+	}
+	ms.Del("hoge")
+	{
+		ok, _ := ms.CompareAndSet("hoge", []byte("piyo"), version, 0)
+		assert.False(t, ok)
+		_, version, _ := ms.GetVersion("hoge")
+		assert.Equal(t, "", version)
+	}
+}
+
+func TestMemcachedStoreBadLength(t *testing.T) {
+	for _, reply := range []string{"VALUE hoge 0 -5\r\n", "VALUE hoge 0 2000000\r\n"} {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func(reply string) {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+			bufio.NewReader(c).ReadString('\n')
+			io.WriteString(c, reply)
+		}(reply)
+		ms, err := sessions.NewMemcachedStore(ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = ms.Get("hoge")
+		assert.Error(t, err, reply)
+		ms.Close()
+		ln.Close()
+	}
+}
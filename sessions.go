@@ -1,13 +1,20 @@
 package sessions
 
 import (
-	"bytes"
+	"bufio"
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/gob"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/codegangsta/negroni"
@@ -15,7 +22,45 @@ import (
 	"golang.org/x/net/context"
 )
 
+var (
+	ErrStoreUnavailable = errors.New("sessions: store unavailable")
+	ErrDecode           = errors.New("sessions: decode failed")
+	ErrEncode           = errors.New("sessions: encode failed")
+	ErrCookieTooLarge   = errors.New("sessions: cookie exceeds 4096 bytes")
+	ErrInvalidConfig    = errors.New("sessions: invalid configuration")
+	ErrConflict         = errors.New("sessions: concurrent modification")
+)
+
+const maxCookieSize = 4096
+
+// maxMergeRetries bounds the compare-and-set attempts after the first conflict
+const maxMergeRetries = 3
+
+// sealer is implemented by stores that keep the session in the cookie value,
+// name is the cookie the value is sealed for
+type sealer interface {
+	Seal(name string, val []byte) (string, error)
+	Open(name, value string) ([]byte, error)
+}
+
+// versionChecker is implemented by stores that have the VersionedStore
+// methods but only support them when the store they wrap does
+type versionChecker interface {
+	versioned() bool
+}
+
+func wrapError(kind, err error) error {
+	return fmt.Errorf("%w: %w", kind, err)
+}
+
 var defaultFlashKey = "_flash"
+
+// bookkeeping stored alongside the values, hidden from Get/Exists/HasKey
+const (
+	createdKey  = "_sessions:created"
+	accessedKey = "_sessions:accessed"
+)
+
 var defaultCookieName = "sessions"
 
 type sessionValues map[string]interface{}
@@ -27,23 +72,60 @@ func init() {
 
 var contextSessionKey = struct{}{}
 
+// sessionsKey lets every Sessions find its own session when several are mounted
+type sessionsKey struct {
+	ss *Sessions
+}
+
+// SessionData is what handlers see of a session
+type SessionData interface {
+	Get(key string) interface{}
+	Exists(key string) bool
+	Set(key string, val interface{})
+	Del(key string)
+	HasKey() bool
+	AddFlash(val interface{}, vars ...string)
+	Flashes(vars ...string) []interface{}
+	NoStore(v ...bool) bool
+	ChangeId(v ...bool) bool
+	Expire(v ...bool) bool
+	Options() *CookieOptions
+}
+
+var _ SessionData = (*session)(nil)
+
+type CookieOptions struct {
+	Path        string
+	Domain      string
+	Expires     time.Time
+	MaxAge      time.Duration
+	Secure      bool
+	HttpOnly    bool
+	SameSite    http.SameSite
+	Partitioned bool
+}
+
 type session struct {
 	ss *Sessions
 
-	sid      string
-	values   sessionValues
-	isNew    bool
-	changeId bool
-	expire   bool
-	noStore  bool
-	written  bool
+	sid       string
+	prefix    string
+	version   string
+	transport Transport
+	values    sessionValues
+	isNew     bool
+	changeId  bool
+	expire    bool
+	noStore   bool
+	changes   map[string]bool
+	sealed    bool
+	refresh   bool
+	finalized bool
+	created   time.Time
+	accessed  time.Time
 
 	// cookie setting
-	Path     string
-	Domain   string
-	Expires  time.Time
-	Secure   bool
-	HttpOnly bool
+	CookieOptions
 }
 
 func (s *session) Get(key string) interface{} {
@@ -60,12 +142,12 @@ func (s *session) Exists(key string) bool {
 
 func (s *session) Set(key string, val interface{}) {
 	s.values[key] = val
-	s.written = true
+	s.change(key, true)
 }
 
 func (s *session) Del(key string) {
 	delete(s.values, key)
-	s.written = true
+	s.change(key, false)
 }
 
 func (s *session) AddFlash(val interface{}, vars ...string) {
@@ -78,7 +160,7 @@ func (s *session) AddFlash(val interface{}, vars ...string) {
 		flashes = v.([]interface{})
 	}
 	s.values[key] = append(flashes, val)
-	s.written = true
+	s.change(key, true)
 }
 
 func (s *session) Flashes(vars ...string) []interface{} {
@@ -90,11 +172,23 @@ func (s *session) Flashes(vars ...string) []interface{} {
 	if v, ok := s.values[key]; ok {
 		delete(s.values, key)
 		flashes = v.([]interface{})
-		s.written = true
+		s.change(key, false)
 	}
 	return flashes
 }
 
+// change records that key was set or deleted during this request
+func (s *session) change(key string, set bool) {
+	if s.changes == nil {
+		s.changes = map[string]bool{}
+	}
+	s.changes[key] = set
+}
+
+func (s *session) written() bool {
+	return 0 < len(s.changes)
+}
+
 func (s *session) NoStore(v ...bool) bool {
 	if 0 < len(v) {
 		s.noStore = v[0]
@@ -116,6 +210,10 @@ func (s *session) Expire(v ...bool) bool {
 	return s.expire
 }
 
+func (s *session) Options() *CookieOptions {
+	return &s.CookieOptions
+}
+
 func (s *session) HasKey() bool {
 	if 0 < len(s.values) {
 		return true
@@ -123,6 +221,83 @@ func (s *session) HasKey() bool {
 	return false
 }
 
+func metaTime(v interface{}) time.Time {
+	var sec int64
+	switch v := v.(type) {
+	case int:
+		sec = int64(v)
+	case int8:
+		sec = int64(v)
+	case int16:
+		sec = int64(v)
+	case int32:
+		sec = int64(v)
+	case int64:
+		sec = v
+	case uint32:
+		sec = int64(v)
+	case uint64:
+		sec = int64(v)
+	case float64:
+		sec = int64(v)
+	case string:
+		sec, _ = strconv.ParseInt(v, 10, 64)
+	}
+	if sec <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(sec, 0)
+}
+
+func (s *session) loadMeta() {
+	if v, ok := s.values[createdKey]; ok {
+		s.created = metaTime(v)
+		delete(s.values, createdKey)
+	}
+	if v, ok := s.values[accessedKey]; ok {
+		s.accessed = metaTime(v)
+		delete(s.values, accessedKey)
+	}
+}
+
+func (s *session) encodedValues() sessionValues {
+	if !s.ss.tracksTime() {
+		return s.values
+	}
+	values := make(sessionValues, len(s.values)+2)
+	for k, v := range s.values {
+		values[k] = v
+	}
+	values[createdKey] = s.created.Unix()
+	values[accessedKey] = s.accessed.Unix()
+	return values
+}
+
+func (s *session) timedOut(now time.Time) bool {
+	if 0 < s.ss.IdleTimeout && !s.accessed.IsZero() && s.ss.IdleTimeout < now.Sub(s.accessed) {
+		return true
+	}
+	if 0 < s.ss.AbsoluteTimeout && !s.created.IsZero() && s.ss.AbsoluteTimeout < now.Sub(s.created) {
+		return true
+	}
+	return false
+}
+
+func (s *session) dueRefresh(now time.Time) bool {
+	if s.isNew {
+		return false
+	}
+	// sessions stored before tracking was enabled pick up their timestamps
+	if s.ss.tracksTime() && s.created.IsZero() {
+		return true
+	}
+	return (s.ss.Sliding || 0 < s.ss.IdleTimeout) && s.ss.RefreshInterval <= now.Sub(s.accessed)
+}
+
+func (s *session) key() string {
+	return s.prefix + s.sid
+}
+
 func (s *session) sidRegenerate() {
 	s.sid = s.ss.SidGenerator()
 }
@@ -133,7 +308,8 @@ func (s *session) needStore() bool {
 	}
 
 	if (s.isNew && !s.ss.NoKeepEmpty && !s.HasKey()) ||
-		s.written ||
+		s.written() ||
+		s.refresh ||
 		s.expire ||
 		s.changeId {
 		return true
@@ -148,33 +324,211 @@ func (s *session) store() error {
 	}
 
 	if s.expire {
-		return s.ss.Store.Del(s.sid)
+		err := s.ss.Store.Del(s.key())
+		if err != nil {
+			return wrapError(ErrStoreUnavailable, err)
+		}
+		return nil
 	}
 
 	if s.changeId {
-		err := s.ss.Store.Del(s.sid)
+		err := s.ss.Store.Del(s.key())
 		if err != nil {
-			return err
+			return wrapError(ErrStoreUnavailable, err)
 		}
 		s.sidRegenerate()
+		s.version = ""
 	}
 
-	b, err := s.ss.Encode(s.values)
-	if err != nil {
-		return err
+	if s.created.IsZero() {
+		s.created = s.ss.now()
+	}
+	if s.isNew || s.refresh {
+		s.accessed = s.ss.now()
+	}
+
+	if sl, ok := s.ss.Store.(sealer); ok {
+		b, err := s.encode()
+		if err != nil {
+			return err
+		}
+		v, err := sl.Seal(s.ss.CookieName, b)
+		if err != nil {
+			return wrapError(ErrEncode, err)
+		}
+		// browsers drop the whole Set-Cookie line when it is too large,
+		// attributes and signature included
+		value, o := s.ss.signSid(v), s.cookieOptions()
+		for _, t := range s.ss.transports() {
+			if ct, ok := t.(CookieTransport); ok && maxCookieSize < len(newCookie(ct.Name, value, o).String()) {
+				return wrapError(ErrEncode, ErrCookieTooLarge)
+			}
+		}
+		s.sid = v
+		s.sealed = true
+		return nil
 	}
 
-	err = s.ss.Store.Set(s.sid, b)
+	if fs, ok := s.ss.Store.(FieldStore); ok {
+		return s.storeFields(fs)
+	}
+
+	if vs, ok := s.ss.versionedStore(); ok {
+		return s.compareAndSet(vs)
+	}
+
+	// another request may have stored the session since it was loaded
+	if !s.isNew && !s.changeId {
+		stored, _, err := s.reload()
+		if err != nil {
+			return err
+		}
+		if stored == nil {
+			// deleted meanwhile, e.g. by a logout, and it stays deleted
+			return nil
+		}
+		s.merge(stored)
+	}
+
+	b, err := s.encode()
 	if err != nil {
 		return err
 	}
+	err = s.ss.storeSet(s.key(), b)
+	if err != nil {
+		return wrapError(ErrStoreUnavailable, err)
+	}
+
+	return nil
+}
+
+// compareAndSet writes the values unless another request stored the session
+// since it was loaded, in which case the stored values are merged in through
+// Merge and it retries. Without Merge, or when the session was deleted
+// meanwhile, the conflict is reported.
+func (s *session) compareAndSet(vs VersionedStore) error {
+	for i := 0; ; i++ {
+		b, err := s.encode()
+		if err != nil {
+			return err
+		}
+		ok, err := vs.CompareAndSet(s.key(), b, s.version, s.ss.ttl())
+		if err != nil {
+			return wrapError(ErrStoreUnavailable, err)
+		}
+		if ok {
+			return nil
+		}
+		if s.ss.Merge == nil || maxMergeRetries <= i {
+			return ErrConflict
+		}
+
+		stored, version, err := s.reload()
+		if err != nil {
+			return err
+		}
+		if stored == nil && !s.isNew && !s.changeId {
+			return ErrConflict
+		}
+		s.merge(stored)
+		s.version = version
+	}
+}
 
+// storeFields writes the keys changed by this request, or every key when the
+// stored session is new
+func (s *session) storeFields(fs FieldStore) error {
+	values := s.encodedValues()
+	set := map[string][]byte{}
+	var del []string
+	put := func(k string) error {
+		b, err := marshalValue(s.ss.codec(), values[k])
+		if err != nil {
+			return wrapError(ErrEncode, err)
+		}
+		set[k] = b
+		return nil
+	}
+	if s.isNew || s.changeId {
+		for k := range values {
+			if err := put(k); err != nil {
+				return err
+			}
+		}
+	} else {
+		for k, isSet := range s.changes {
+			if !isSet {
+				del = append(del, k)
+				continue
+			}
+			if err := put(k); err != nil {
+				return err
+			}
+		}
+		for _, k := range []string{createdKey, accessedKey} {
+			if _, ok := values[k]; ok {
+				if err := put(k); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	// a session deleted meanwhile, e.g. by a logout, is not written back
+	_, err := fs.SetFields(s.key(), set, del, s.ss.ttl(), s.isNew || s.changeId)
+	if err != nil {
+		return wrapError(ErrStoreUnavailable, err)
+	}
 	return nil
 }
 
+func (s *session) encode() ([]byte, error) {
+	b, err := s.ss.Encode(s.encodedValues())
+	if err != nil {
+		return nil, wrapError(ErrEncode, err)
+	}
+	return b, nil
+}
+
+// reload reads the stored values without bookkeeping, nil when there are none
+func (s *session) reload() (sessionValues, string, error) {
+	values, version, err := s.ss.load(s.key())
+	if err != nil || values == nil {
+		return nil, version, err
+	}
+	delete(values, createdKey)
+	delete(values, accessedKey)
+	return values, version, nil
+}
+
+// merge combines the stored values with this request's, through Merge when
+// it is set and by replaying the changed keys otherwise
+func (s *session) merge(stored sessionValues) {
+	if stored == nil {
+		stored = sessionValues{}
+	}
+	if s.ss.Merge != nil {
+		s.values = s.ss.Merge(stored, s.values)
+		if s.values == nil {
+			s.values = sessionValues{}
+		}
+		return
+	}
+	for k, set := range s.changes {
+		if set {
+			stored[k] = s.values[k]
+		} else {
+			delete(stored, k)
+		}
+	}
+	s.values = stored
+}
+
 func (s *session) needSetCookie() bool {
 	if (s.isNew && !s.ss.NoKeepEmpty && !s.HasKey()) ||
-		(s.isNew && s.written) ||
+		(s.isNew && s.written()) ||
+		s.sealed ||
+		(s.refresh && s.ss.Sliding) ||
+		(s.ss.followsMaxAge() && s.needStore()) ||
 		s.expire ||
 		s.changeId {
 		return true
@@ -187,20 +541,43 @@ func (s *session) setCookie(w http.ResponseWriter) {
 		return
 	}
 
-	cookie := &http.Cookie{
-		Name:     s.ss.CookieName,
-		Value:    s.sid,
-		Path:     s.Path,
-		Domain:   s.Domain,
-		Expires:  s.Expires,
-		Secure:   s.Secure,
-		HttpOnly: s.HttpOnly,
+	o := s.cookieOptions()
+	value := s.ss.signSid(s.sid)
+	if s.transport != nil {
+		s.transport.Emit(w, value, o)
+		return
+	}
+	// the client has not picked a transport yet, offer every one
+	for _, t := range s.ss.transports() {
+		t.Emit(w, value, o)
+	}
+}
+
+// cookieOptions are the options the cookie is emitted with
+func (s *session) cookieOptions() CookieOptions {
+	o := s.CookieOptions
+	if 0 < o.MaxAge {
+		o.Expires = s.ss.now().Add(o.MaxAge)
 	}
 	if s.expire {
-		cookie.Expires = time.Now()
+		o.Expires = time.Now()
+		o.MaxAge = -1
 	}
+	return o
+}
 
-	http.SetCookie(w, cookie)
+func validateCookie(name string, o CookieOptions) error {
+	switch {
+	case strings.HasPrefix(name, "__Host-") && (!o.Secure || o.Path != "/" || o.Domain != ""):
+		return fmt.Errorf("%w: %s cookie needs Secure, Path \"/\" and no Domain", ErrInvalidConfig, name)
+	case strings.HasPrefix(name, "__Secure-") && !o.Secure:
+		return fmt.Errorf("%w: %s cookie needs Secure", ErrInvalidConfig, name)
+	case o.SameSite == http.SameSiteNoneMode && !o.Secure:
+		return fmt.Errorf("%w: SameSite=None needs Secure", ErrInvalidConfig)
+	case o.Partitioned && !o.Secure:
+		return fmt.Errorf("%w: Partitioned needs Secure", ErrInvalidConfig)
+	}
+	return nil
 }
 
 func sidGenerator() string {
@@ -227,10 +604,48 @@ type Sessions struct {
 	Path         string
 	Domain       string
 	Expires      time.Time
+	MaxAge       time.Duration
 	Secure       bool
 	HttpOnly     bool
+	SameSite     http.SameSite
+	Partitioned  bool
+	TTL          time.Duration
+	Codec        Codec
+	Clock        Clock
 	SidGenerator func() string
 	SidValidator func(sid string) bool
+	// KeyPrefix derives a store key namespace per request, e.g. from r.Host
+	KeyPrefix func(r *http.Request) string
+	// ErrorHandler receives load and save errors, Middleware panics when it is nil
+	ErrorHandler func(c context.Context, w http.ResponseWriter, r *http.Request, err error)
+	// ResetOnDecodeError starts a fresh session instead of reporting ErrDecode
+	ResetOnDecodeError bool
+	// Transports are tried in order to find the session id, the default is
+	// a single CookieTransport named CookieName
+	Transports []Transport
+	// SignKeys enables HMAC signed cookie values, the first key signs and
+	// every key is accepted when verifying
+	SignKeys [][]byte
+	// Sliding reissues the cookie and rewrites the store entry on activity,
+	// at most once per RefreshInterval
+	Sliding         bool
+	RefreshInterval time.Duration
+	// IdleTimeout and AbsoluteTimeout are checked against the last access and
+	// creation times kept in the store. The last access is only rewritten once
+	// per RefreshInterval, so keep that well below IdleTimeout.
+	IdleTimeout     time.Duration
+	AbsoluteTimeout time.Duration
+	OnTimeout       func(c context.Context, r *http.Request, sid string)
+	// CheckConflicts saves through a VersionedStore with compare-and-set, so a
+	// request does not overwrite values stored by another one since it loaded
+	// the session. Merge combines the values stored meanwhile with this
+	// request's values and retries, without it the write fails with
+	// ErrConflict. Without CheckConflicts the stored values are re-read before
+	// writing and the keys this request set or deleted are replayed onto them,
+	// or passed through Merge when it is set, but a write can slip in between.
+	// A session deleted by another request meanwhile is not written back.
+	CheckConflicts bool
+	Merge          func(stored, local map[string]interface{}) map[string]interface{}
 }
 
 func New(store Store, vars ...string) *Sessions {
@@ -244,74 +659,408 @@ func New(store Store, vars ...string) *Sessions {
 	}
 }
 
-func (ss *Sessions) getSessionValues(r *http.Request) (string, sessionValues, error) {
-	cookie, _ := r.Cookie(ss.CookieName)
-	if cookie == nil {
-		return "", sessionValues{}, nil
+func sidSignature(key []byte, sid string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(sid))
+	return mac.Sum(nil)
+}
+
+func (ss *Sessions) signSid(sid string) string {
+	if len(ss.SignKeys) == 0 {
+		return sid
+	}
+	return sid + "." + base64.RawURLEncoding.EncodeToString(sidSignature(ss.SignKeys[0], sid))
+}
+
+func (ss *Sessions) verifySid(value string) (string, bool) {
+	if len(ss.SignKeys) == 0 {
+		return value, true
 	}
-	sid := cookie.Value
-	if !ss.SidValidator(sid) {
-		return "", sessionValues{}, nil
+	i := strings.LastIndexByte(value, '.')
+	if i < 0 {
+		return "", false
 	}
-	encodedValue, err := ss.Store.Get(sid)
+	sid := value[:i]
+	sig, err := base64.RawURLEncoding.DecodeString(value[i+1:])
 	if err != nil {
-		return "", sessionValues{}, err
+		return "", false
 	}
-	if len(encodedValue) == 0 {
-		return "", sessionValues{}, nil
+	for _, key := range ss.SignKeys {
+		if hmac.Equal(sig, sidSignature(key, sid)) {
+			return sid, true
+		}
+	}
+	return "", false
+}
+
+func (ss *Sessions) keyPrefix(r *http.Request) string {
+	if _, ok := ss.Store.(sealer); ok || ss.KeyPrefix == nil {
+		return ""
+	}
+	return ss.KeyPrefix(r)
+}
+
+func (ss *Sessions) transports() []Transport {
+	if len(ss.Transports) == 0 {
+		return []Transport{CookieTransport{Name: ss.CookieName}}
+	}
+	return ss.Transports
+}
+
+// extract asks the transports in order and takes the first value naming a
+// stored session, a stale or forged value does not hide the ones after it.
+// Without a session the new one goes out on the first transport that
+// carried a value.
+func (ss *Sessions) extract(r *http.Request, prefix string) (string, sessionValues, string, Transport, error) {
+	var first Transport
+	for _, t := range ss.transports() {
+		value, ok := t.Extract(r)
+		if !ok {
+			continue
+		}
+		if first == nil {
+			first = t
+		}
+		sid, values, version, err := ss.getSessionValues(value, prefix)
+		if err != nil {
+			return "", sessionValues{}, "", t, err
+		}
+		if sid != "" {
+			return sid, values, version, t, nil
+		}
+	}
+	return "", sessionValues{}, "", first, nil
+}
+
+func (ss *Sessions) validate(o CookieOptions) error {
+	for _, t := range ss.transports() {
+		if v, ok := t.(interface {
+			Validate(o CookieOptions) error
+		}); ok {
+			if err := v.Validate(o); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (ss *Sessions) getSessionValues(value, prefix string) (string, sessionValues, string, error) {
+	if value == "" {
+		return "", sessionValues{}, "", nil
+	}
+	sid, ok := ss.verifySid(value)
+	if !ok {
+		return "", sessionValues{}, "", nil
 	}
-	decodedValue, err := ss.Decode(encodedValue)
+	if _, ok := ss.Store.(sealer); !ok && !ss.SidValidator(sid) {
+		return "", sessionValues{}, "", nil
+	}
+	values, version, err := ss.load(prefix + sid)
 	if err != nil {
-		return "", sessionValues{}, err
+		return "", sessionValues{}, "", err
+	}
+	if values == nil {
+		return "", sessionValues{}, "", nil
 	}
-	return sid, decodedValue, nil
+	return sid, values, version, nil
 }
 
-func (ss *Sessions) Middleware(h fever.Handler) fever.Handler {
+// load reads and decodes the stored values, nil when there are none
+func (ss *Sessions) load(key string) (sessionValues, string, error) {
+	if fs, ok := ss.Store.(FieldStore); ok {
+		fields, err := fs.GetFields(key)
+		if err != nil {
+			return nil, "", wrapError(ErrStoreUnavailable, err)
+		}
+		if fields == nil {
+			return nil, "", nil
+		}
+		values := make(sessionValues, len(fields))
+		for k, b := range fields {
+			v, err := unmarshalValue(ss.codec(), b)
+			if err != nil {
+				return nil, "", wrapError(ErrDecode, err)
+			}
+			values[k] = v
+		}
+		return values, "", nil
+	}
+	b, version, err := ss.storeGet(key)
+	if err != nil {
+		return nil, "", wrapError(ErrStoreUnavailable, err)
+	}
+	if len(b) == 0 {
+		return nil, version, nil
+	}
+	values, err := ss.Decode(b)
+	if err != nil {
+		return nil, "", wrapError(ErrDecode, err)
+	}
+	return values, version, nil
+}
+
+func (ss *Sessions) cookieOptions() CookieOptions {
+	return CookieOptions{
+		Path:        ss.Path,
+		Domain:      ss.Domain,
+		Expires:     ss.Expires,
+		MaxAge:      ss.MaxAge,
+		Secure:      ss.Secure,
+		HttpOnly:    ss.HttpOnly,
+		SameSite:    ss.SameSite,
+		Partitioned: ss.Partitioned,
+	}
+}
+
+// Validate reports cookie settings that browsers would reject
+func (ss *Sessions) Validate() error {
+	return ss.validate(ss.cookieOptions())
+}
+
+func (ss *Sessions) setup() {
+	if err := ss.Validate(); err != nil {
+		panic(err)
+	}
 	if ss.SidGenerator == nil {
 		ss.SidGenerator = sidGenerator
 	}
 	if ss.SidValidator == nil {
 		ss.SidValidator = sidValidator
 	}
+}
+
+func (ss *Sessions) Middleware(h fever.Handler) fever.Handler {
+	ss.setup()
 	return fever.HandlerFunc(func(c context.Context, w http.ResponseWriter, r *http.Request) {
-		nw, ok := w.(negroni.ResponseWriter)
-		if !ok {
-			nw = negroni.NewResponseWriter(w)
-		}
-		sid, values, err := ss.getSessionValues(r)
-		if err != nil {
-			panic(err)
-		}
-		isNew := false
-		if sid == "" {
-			sid = ss.SidGenerator()
-			isNew = true
-		}
-		s := &session{
-			ss:       ss,
-			sid:      sid,
-			values:   values,
-			isNew:    isNew,
-			Path:     ss.Path,
-			Domain:   ss.Domain,
-			Expires:  ss.Expires,
-			Secure:   ss.Secure,
-			HttpOnly: ss.HttpOnly,
-		}
-		c = context.WithValue(c, contextSessionKey, s)
-		nw.Before(func(w negroni.ResponseWriter) {
-			err := ss.finalize(w, s)
-			if err != nil {
-				panic(err)
-			}
+		ss.serve(c, w, r, func(c context.Context, w http.ResponseWriter) {
+			h.ServeHTTP(c, w, r)
 		})
-		h.ServeHTTP(c, nw, r)
 	})
 }
 
+// Handler is Middleware for plain net/http, the session is kept in r.Context()
+func (ss *Sessions) Handler(h http.Handler) http.Handler {
+	ss.setup()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ss.serve(r.Context(), w, r, func(c context.Context, w http.ResponseWriter) {
+			h.ServeHTTP(w, r.WithContext(c))
+		})
+	})
+}
+
+func (ss *Sessions) serve(c context.Context, w http.ResponseWriter, r *http.Request, next func(c context.Context, w http.ResponseWriter)) {
+	nw, ok := w.(negroni.ResponseWriter)
+	if !ok {
+		nw = negroni.NewResponseWriter(w)
+	}
+	prefix := ss.keyPrefix(r)
+	sid, values, version, transport, err := ss.extract(r, prefix)
+	if err != nil {
+		if !ss.ResetOnDecodeError || !errors.Is(err, ErrDecode) {
+			ss.handleError(c, w, r, err)
+			return
+		}
+	}
+	isNew := false
+	if sid == "" {
+		sid = ss.SidGenerator()
+		isNew = true
+	}
+	s := &session{
+		ss:            ss,
+		sid:           sid,
+		prefix:        prefix,
+		version:       version,
+		transport:     transport,
+		values:        values,
+		isNew:         isNew,
+		CookieOptions: ss.cookieOptions(),
+	}
+	s.loadMeta()
+	if !isNew && s.timedOut(ss.now()) {
+		err := ss.Store.Del(s.key())
+		if err != nil {
+			ss.handleError(c, w, r, wrapError(ErrStoreUnavailable, err))
+			return
+		}
+		if ss.OnTimeout != nil {
+			ss.OnTimeout(c, r, sid)
+		}
+		s.sid = ss.SidGenerator()
+		s.values = sessionValues{}
+		s.version = ""
+		s.isNew = true
+		s.created = time.Time{}
+	}
+	s.refresh = s.dueRefresh(ss.now())
+	c = context.WithValue(c, contextSessionKey, s)
+	c = context.WithValue(c, sessionsKey{ss}, s)
+	sw := &sessionWriter{
+		ResponseWriter: nw,
+		finalize: func() error {
+			return ss.finalize(nw, s)
+		},
+		onError: func(err error) {
+			ss.handleError(c, nw, r, err)
+		},
+	}
+	next(c, sw)
+	// cover handlers that wrote nothing
+	sw.start()
+}
+
+// sessionWriter saves the session right before the handler's headers go out.
+// When that fails the ErrorHandler answers instead, and whatever the handler
+// writes afterwards is discarded.
+type sessionWriter struct {
+	negroni.ResponseWriter
+	finalize func() error
+	onError  func(err error)
+	started  bool
+	failed   bool
+}
+
+func (sw *sessionWriter) start() {
+	if sw.started {
+		return
+	}
+	sw.started = true
+	if err := sw.finalize(); err != nil {
+		sw.failed = true
+		sw.onError(err)
+	}
+}
+
+func (sw *sessionWriter) WriteHeader(code int) {
+	sw.start()
+	if sw.failed {
+		return
+	}
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *sessionWriter) Write(b []byte) (int, error) {
+	sw.start()
+	if sw.failed {
+		return len(b), nil
+	}
+	return sw.ResponseWriter.Write(b)
+}
+
+func (sw *sessionWriter) Flush() {
+	sw.start()
+	if sw.failed {
+		return
+	}
+	sw.ResponseWriter.Flush()
+}
+
+var errSessionNotSaved = errors.New("sessions: the ErrorHandler answered, the session could not be saved")
+
+// Hijack saves the session first, the handler takes over the connection
+// after that
+func (sw *sessionWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	sw.start()
+	if sw.failed {
+		return nil, nil, errSessionNotSaved
+	}
+	h, ok := sw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("sessions: %T cannot be hijacked", sw.ResponseWriter)
+	}
+	return h.Hijack()
+}
+
+// CloseNotify returns a channel that never fires when the underlying writer
+// cannot notify
+func (sw *sessionWriter) CloseNotify() <-chan bool {
+	if cn, ok := sw.ResponseWriter.(http.CloseNotifier); ok {
+		return cn.CloseNotify()
+	}
+	return make(chan bool)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (sw *sessionWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+func (ss *Sessions) now() time.Time {
+	if ss.Clock == nil {
+		return time.Now()
+	}
+	return ss.Clock.Now()
+}
+
+// ttl is the store lifetime, TTL when set and the cookie MaxAge otherwise
+func (ss *Sessions) ttl() time.Duration {
+	if 0 < ss.TTL {
+		return ss.TTL
+	}
+	return ss.MaxAge
+}
+
+// followsMaxAge reports whether every store write renews the lifetime to
+// MaxAge, the cookie is then reissued with it so both expire together
+func (ss *Sessions) followsMaxAge() bool {
+	return ss.TTL <= 0 && 0 < ss.MaxAge
+}
+
+func (ss *Sessions) tracksTime() bool {
+	return (ss.Sliding && 0 < ss.RefreshInterval) || 0 < ss.IdleTimeout || 0 < ss.AbsoluteTimeout
+}
+
+func (ss *Sessions) versionedStore() (VersionedStore, bool) {
+	if !ss.CheckConflicts {
+		return nil, false
+	}
+	vs, ok := ss.Store.(VersionedStore)
+	if vc, wraps := ss.Store.(versionChecker); ok && wraps && !vc.versioned() {
+		return nil, false
+	}
+	return vs, ok
+}
+
+func (ss *Sessions) storeGet(sid string) ([]byte, string, error) {
+	if sl, ok := ss.Store.(sealer); ok {
+		b, err := sl.Open(ss.CookieName, sid)
+		return b, "", err
+	}
+	if vs, ok := ss.versionedStore(); ok {
+		return vs.GetVersion(sid)
+	}
+	b, err := ss.Store.Get(sid)
+	return b, "", err
+}
+
+func (ss *Sessions) storeSet(sid string, b []byte) error {
+	if ttl := ss.ttl(); 0 < ttl {
+		if ts, ok := ss.Store.(TTLStore); ok {
+			return ts.SetWithTTL(sid, b, ttl)
+		}
+	}
+	return ss.Store.Set(sid, b)
+}
+
+func (ss *Sessions) handleError(c context.Context, w http.ResponseWriter, r *http.Request, err error) {
+	if ss.ErrorHandler == nil {
+		panic(err)
+	}
+	ss.ErrorHandler(c, w, r, err)
+}
+
 func (ss *Sessions) finalize(w http.ResponseWriter, s *session) error {
-	err := s.store()
+	if s.finalized {
+		return nil
+	}
+	s.finalized = true
+	// the handler may have changed the cookie settings of this session
+	err := ss.validate(s.CookieOptions)
+	if err != nil {
+		return err
+	}
+	err = s.store()
 	if err != nil {
 		return err
 	}
@@ -319,27 +1068,52 @@ func (ss *Sessions) finalize(w http.ResponseWriter, s *session) error {
 	return nil
 }
 
+func (ss *Sessions) codec() Codec {
+	if ss.Codec == nil {
+		return GobCodec{}
+	}
+	return ss.Codec
+}
+
 func (ss *Sessions) Encode(val sessionValues) ([]byte, error) {
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	err := enc.Encode(&val)
+	b, err := ss.codec().Marshal(val)
 	if err != nil {
 		return []byte{}, err
 	}
-	return buf.Bytes(), nil
+	return b, nil
 }
 
 func (ss *Sessions) Decode(b []byte) (sessionValues, error) {
-	buf := bytes.NewBuffer(b)
-	dec := gob.NewDecoder(buf)
 	var val sessionValues
-	err := dec.Decode(&val)
+	err := ss.codec().Unmarshal(b, &val)
 	if err != nil {
 		return sessionValues{}, err
 	}
+	if val == nil {
+		val = sessionValues{}
+	}
 	return val, nil
 }
 
-func Session(c context.Context) *session {
+// Session panics when the middleware is not installed, see FromContext
+func Session(c context.Context) SessionData {
 	return c.Value(contextSessionKey).(*session)
 }
+
+func FromContext(c context.Context) (SessionData, bool) {
+	s, ok := c.Value(contextSessionKey).(*session)
+	if !ok {
+		return nil, false
+	}
+	return s, true
+}
+
+// Get returns the session of this Sessions even when another middleware
+// mounted inside it shadows Session(c)
+func (ss *Sessions) Get(c context.Context) (SessionData, bool) {
+	s, ok := c.Value(sessionsKey{ss}).(*session)
+	if !ok {
+		return nil, false
+	}
+	return s, true
+}
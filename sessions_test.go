@@ -2,18 +2,23 @@ package sessions_test
 
 import (
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/cookiejar"
 	"net/http/httptest"
 	"regexp"
+	"strings"
 	"testing"
+	"time"
 
 	"golang.org/x/net/context"
 
+	"github.com/garyburd/redigo/redis"
 	"github.com/mix3/fever-sessions"
 	"github.com/mix3/fever/mux"
+	"github.com/soh335/go-test-redisserver"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -427,3 +432,1194 @@ func TestChangeId(t *testing.T) {
 		}
 	}
 }
+
+type ttlRecorder struct {
+	*sessions.MemoryStore
+	ttl  time.Duration
+	sets int
+}
+
+func (tr *ttlRecorder) SetWithTTL(key string, val []byte, ttl time.Duration) error {
+	tr.ttl = ttl
+	tr.sets++
+	return tr.MemoryStore.SetWithTTL(key, val, ttl)
+}
+
+func TestTTL(t *testing.T) {
+	store := &ttlRecorder{MemoryStore: sessions.NewMemoryStore()}
+	defer func() {
+		err := store.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+	ss := sessions.New(store, "myapp_session")
+	ss.TTL = 30 * time.Minute
+	m := mux.New()
+	m.Use(ss.Middleware)
+	m.Get("/").ThenFunc(func(c context.Context, w http.ResponseWriter, r *http.Request) {
+		s := sessions.Session(c)
+		s.Set("username", "foo")
+		fmt.Fprintf(w, "TOP")
+	})
+	ts := httptest.NewServer(m)
+	defer ts.Close()
+	c := newClient(t)
+	{
+		_, body, _ := c.Get(t, ts.URL, "myapp_session")
+		assert.Equal(t, "TOP", body)
+		assert.Equal(t, 30*time.Minute, store.ttl)
+	}
+}
+
+func TestKeyPrefix(t *testing.T) {
+	store := sessions.NewMemoryStore()
+	defer func() {
+		err := store.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+	ss := sessions.New(store, "myapp_session")
+	ss.KeyPrefix = func(r *http.Request) string {
+		return r.Host + ":"
+	}
+	m := mux.New()
+	m.Use(ss.Middleware)
+	m.Get("/").ThenFunc(func(c context.Context, w http.ResponseWriter, r *http.Request) {
+		s := sessions.Session(c)
+		v := 1
+		if s.Exists("counter") {
+			v = s.Get("counter").(int) + 1
+		}
+		s.Set("counter", v)
+		fmt.Fprintf(w, "counter=>%d", v)
+	})
+	ts := httptest.NewServer(m)
+	defer ts.Close()
+	c := newClient(t)
+	re := regexp.MustCompile("myapp_session=([a-f0-9]{40})")
+	var sid string
+	{
+		_, body, header := c.Get(t, ts.URL, "myapp_session")
+		assert.Equal(t, "counter=>1", body)
+		if ok := assert.Len(t, header["Set-Cookie"], 1); ok {
+			sid = re.FindStringSubmatch(header["Set-Cookie"][0])[1]
+		}
+	}
+	{
+		_, body, _ := c.Get(t, ts.URL, "myapp_session")
+		assert.Equal(t, "counter=>2", body)
+	}
+	{
+		v, _ := store.Get(sid)
+		assert.Len(t, v, 0)
+		v, _ = store.Get(ts.Listener.Addr().String() + ":" + sid)
+		assert.NotEmpty(t, v)
+	}
+}
+
+type brokenStore struct {
+	*sessions.MemoryStore
+	getErr error
+	setErr error
+}
+
+func (bs *brokenStore) Get(key string) ([]byte, error) {
+	if bs.getErr != nil {
+		return nil, bs.getErr
+	}
+	return bs.MemoryStore.Get(key)
+}
+
+func (bs *brokenStore) Set(key string, val []byte) error {
+	if bs.setErr != nil {
+		return bs.setErr
+	}
+	return bs.MemoryStore.Set(key, val)
+}
+
+func TestErrorHandler(t *testing.T) {
+	store := &brokenStore{MemoryStore: sessions.NewMemoryStore()}
+	defer func() {
+		err := store.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+	ss := sessions.New(store, "myapp_session")
+	var handled error
+	ss.ErrorHandler = func(c context.Context, w http.ResponseWriter, r *http.Request, err error) {
+		handled = err
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}
+	m := mux.New()
+	m.Use(ss.Middleware)
+	m.Get("/").ThenFunc(func(c context.Context, w http.ResponseWriter, r *http.Request) {
+		s := sessions.Session(c)
+		s.Set("username", "foo")
+		fmt.Fprintf(w, "TOP")
+	})
+	ts := httptest.NewServer(m)
+	defer ts.Close()
+	c := newClient(t)
+	re := regexp.MustCompile("myapp_session=([a-f0-9]{40})")
+	var sid string
+	{
+		_, body, header := c.Get(t, ts.URL, "myapp_session")
+		assert.Equal(t, "TOP", body)
+		if ok := assert.Len(t, header["Set-Cookie"], 1); ok {
+			sid = re.FindStringSubmatch(header["Set-Cookie"][0])[1]
+		}
+		assert.NoError(t, handled)
+	}
+	store.getErr = errors.New("connection refused")
+	{
+		res, _, _ := c.Get(t, ts.URL, "myapp_session")
+		assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+		assert.True(t, errors.Is(handled, sessions.ErrStoreUnavailable))
+		assert.True(t, errors.Is(handled, store.getErr))
+	}
+	store.getErr = nil
+	store.setErr = errors.New("connection refused")
+	handled = nil
+	{
+		res, body, _ := c.Get(t, ts.URL, "myapp_session")
+		assert.True(t, errors.Is(handled, sessions.ErrStoreUnavailable))
+		// the handler's own response is dropped
+		assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+		assert.Equal(t, "unavailable\n", body)
+	}
+	store.setErr = nil
+	store.MemoryStore.Set(sid, []byte("broken"))
+	handled = nil
+	{
+		res, _, _ := c.Get(t, ts.URL, "myapp_session")
+		assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+		assert.True(t, errors.Is(handled, sessions.ErrDecode))
+	}
+	ss.ResetOnDecodeError = true
+	handled = nil
+	{
+		_, body, header := c.Get(t, ts.URL, "myapp_session")
+		assert.Equal(t, "TOP", body)
+		assert.NoError(t, handled)
+		if ok := assert.Len(t, header["Set-Cookie"], 1); ok {
+			assert.NotEqual(t, sid, re.FindStringSubmatch(header["Set-Cookie"][0])[1])
+		}
+	}
+}
+
+type countingStore struct {
+	*sessions.MemoryStore
+	gets int
+	sets int
+}
+
+func (cs *countingStore) Get(key string) ([]byte, error) {
+	cs.gets++
+	return cs.MemoryStore.Get(key)
+}
+
+func (cs *countingStore) Set(key string, val []byte) error {
+	cs.sets++
+	return cs.MemoryStore.Set(key, val)
+}
+
+func TestFinalizeWithoutWrite(t *testing.T) {
+	store := &countingStore{MemoryStore: sessions.NewMemoryStore()}
+	defer func() {
+		err := store.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+	ss := sessions.New(store, "myapp_session")
+	ss.NoKeepEmpty = true
+	m := mux.New()
+	m.Use(ss.Middleware)
+	m.Get("/").ThenFunc(func(c context.Context, w http.ResponseWriter, r *http.Request) {
+		s := sessions.Session(c)
+		fmt.Fprintf(w, "%v", s.Get("via"))
+	})
+	m.Get("/empty").ThenFunc(func(c context.Context, w http.ResponseWriter, r *http.Request) {
+		sessions.Session(c).Set("via", "empty")
+	})
+	m.Get("/redirect").ThenFunc(func(c context.Context, w http.ResponseWriter, r *http.Request) {
+		sessions.Session(c).Set("via", "redirect")
+		http.Redirect(w, r, "/", http.StatusFound)
+	})
+	m.Get("/nocontent").ThenFunc(func(c context.Context, w http.ResponseWriter, r *http.Request) {
+		sessions.Session(c).Set("via", "nocontent")
+		w.WriteHeader(http.StatusNoContent)
+	})
+	ts := httptest.NewServer(m)
+	defer ts.Close()
+	for _, path := range []string{"/empty", "/redirect", "/nocontent"} {
+		c := newClient(t)
+		c.client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+		store.sets = 0
+		{
+			_, _, header := c.Get(t, ts.URL+path, "myapp_session")
+			assert.Len(t, header["Set-Cookie"], 1, path)
+			assert.Equal(t, 1, store.sets, path)
+		}
+		{
+			_, body, _ := c.Get(t, ts.URL, "myapp_session")
+			assert.Equal(t, path[1:], body)
+		}
+	}
+}
+
+func TestCookieStoreSession(t *testing.T) {
+	store, err := sessions.NewCookieStore([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var handled error
+	ss := sessions.New(store, "myapp_session")
+	ss.ErrorHandler = func(c context.Context, w http.ResponseWriter, r *http.Request, err error) {
+		handled = err
+	}
+	m := mux.New()
+	m.Use(ss.Middleware)
+	m.Get("/").ThenFunc(func(c context.Context, w http.ResponseWriter, r *http.Request) {
+		s := sessions.Session(c)
+		if flashes := s.Flashes(); 0 < len(flashes) {
+			fmt.Fprintf(w, "Flashes %v", flashes[0])
+			return
+		}
+		v := 1
+		if s.Exists("counter") {
+			v = s.Get("counter").(int) + 1
+		}
+		s.Set("counter", v)
+		fmt.Fprintf(w, "counter=>%d", v)
+	})
+	m.Get("/flash").ThenFunc(func(c context.Context, w http.ResponseWriter, r *http.Request) {
+		s := sessions.Session(c)
+		s.ChangeId(true)
+		s.AddFlash("hoge")
+		fmt.Fprintf(w, "AddFlash")
+	})
+	m.Get("/large").ThenFunc(func(c context.Context, w http.ResponseWriter, r *http.Request) {
+		s := sessions.Session(c)
+		s.Set("large", strings.Repeat("x", 4096))
+	})
+	m.Get("/logout").ThenFunc(func(c context.Context, w http.ResponseWriter, r *http.Request) {
+		s := sessions.Session(c)
+		s.Expire(true)
+		fmt.Fprintf(w, "LOGOUT")
+	})
+	ts := httptest.NewServer(m)
+	defer ts.Close()
+	c := newClient(t)
+	re := regexp.MustCompile("myapp_session=([A-Za-z0-9_-]+)")
+	var value string
+	{
+		_, body, header := c.Get(t, ts.URL, "myapp_session")
+		assert.Equal(t, "counter=>1", body)
+		if ok := assert.Len(t, header["Set-Cookie"], 1); ok {
+			value = re.FindStringSubmatch(header["Set-Cookie"][0])[1]
+		}
+	}
+	{
+		_, body, header := c.Get(t, ts.URL, "myapp_session")
+		assert.Equal(t, "counter=>2", body)
+		if ok := assert.Len(t, header["Set-Cookie"], 1); ok {
+			assert.NotEqual(t, value, re.FindStringSubmatch(header["Set-Cookie"][0])[1])
+		}
+	}
+	{
+		_, body, header := c.Get(t, ts.URL+"/flash", "myapp_session")
+		assert.Equal(t, "AddFlash", body)
+		assert.Len(t, header["Set-Cookie"], 1)
+	}
+	{
+		_, body, _ := c.Get(t, ts.URL, "myapp_session")
+		assert.Equal(t, "Flashes hoge", body)
+	}
+	{
+		_, body, _ := c.Get(t, ts.URL, "myapp_session")
+		assert.Equal(t, "counter=>3", body)
+	}
+	{
+		c.Get(t, ts.URL+"/large", "myapp_session")
+		assert.True(t, errors.Is(handled, sessions.ErrCookieTooLarge))
+	}
+	{
+		_, body, header := c.Get(t, ts.URL+"/logout", "myapp_session")
+		assert.Equal(t, "LOGOUT", body)
+		assert.Len(t, header["Set-Cookie"], 1)
+	}
+	{
+		_, body, _ := c.Get(t, ts.URL, "myapp_session")
+		assert.Equal(t, "counter=>1", body)
+	}
+}
+
+func TestCookieStoreSessionSize(t *testing.T) {
+	store, err := sessions.NewCookieStore([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var handled error
+	ss := sessions.New(store, "myapp_session")
+	ss.SignKeys = [][]byte{[]byte("key")}
+	// the value alone fits, the attributes push the cookie over the limit
+	ss.Path = "/" + strings.Repeat("p", 3000)
+	ss.ErrorHandler = func(c context.Context, w http.ResponseWriter, r *http.Request, err error) {
+		handled = err
+	}
+	m := mux.New()
+	m.Use(ss.Middleware)
+	m.Get("/").ThenFunc(func(c context.Context, w http.ResponseWriter, r *http.Request) {
+		sessions.Session(c).Set("value", strings.Repeat("x", 1000))
+	})
+	ts := httptest.NewServer(m)
+	defer ts.Close()
+	c := newClient(t)
+	_, _, header := c.Get(t, ts.URL, "myapp_session")
+	assert.True(t, errors.Is(handled, sessions.ErrCookieTooLarge))
+	assert.Len(t, header["Set-Cookie"], 0)
+}
+
+func TestSignedSid(t *testing.T) {
+	store := &countingStore{MemoryStore: sessions.NewMemoryStore()}
+	defer func() {
+		err := store.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+	ss := sessions.New(store, "myapp_session")
+	ss.SignKeys = [][]byte{[]byte("old-key")}
+	m := mux.New()
+	m.Use(ss.Middleware)
+	m.Get("/").ThenFunc(func(c context.Context, w http.ResponseWriter, r *http.Request) {
+		s := sessions.Session(c)
+		v := 1
+		if s.Exists("counter") {
+			v = s.Get("counter").(int) + 1
+		}
+		s.Set("counter", v)
+		fmt.Fprintf(w, "counter=>%d", v)
+	})
+	ts := httptest.NewServer(m)
+	defer ts.Close()
+	re := regexp.MustCompile(`myapp_session=([a-f0-9]{40})\.([A-Za-z0-9_-]+)`)
+	get := func(value string) (string, []string) {
+		req, _ := http.NewRequest("GET", ts.URL, nil)
+		req.AddCookie(&http.Cookie{Name: "myapp_session", Value: value})
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		return string(body), res.Header["Set-Cookie"]
+	}
+	var sid, value string
+	{
+		body, cookies := get("")
+		assert.Equal(t, "counter=>1", body)
+		if ok := assert.Len(t, cookies, 1); ok && assert.Regexp(t, re, cookies[0]) {
+			match := re.FindStringSubmatch(cookies[0])
+			sid, value = match[1], match[1]+"."+match[2]
+		}
+	}
+	{
+		body, cookies := get(value)
+		assert.Equal(t, "counter=>2", body)
+		assert.Len(t, cookies, 0)
+	}
+	store.gets = 0
+	{
+		body, cookies := get(sid)
+		assert.Equal(t, "counter=>1", body)
+		assert.Len(t, cookies, 1)
+		body, cookies = get(sid + ".AAAA")
+		assert.Equal(t, "counter=>1", body)
+		assert.Len(t, cookies, 1)
+		assert.Equal(t, 0, store.gets)
+	}
+	ss.SignKeys = [][]byte{[]byte("new-key"), []byte("old-key")}
+	{
+		body, _ := get(value)
+		assert.Equal(t, "counter=>3", body)
+	}
+	ss.SignKeys = [][]byte{[]byte("new-key")}
+	{
+		body, _ := get(value)
+		assert.Equal(t, "counter=>1", body)
+	}
+}
+
+func TestMaxAge(t *testing.T) {
+	store := &ttlRecorder{MemoryStore: sessions.NewMemoryStore()}
+	defer func() {
+		err := store.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+	clock := newFakeClock()
+	ss := sessions.New(store, "myapp_session")
+	ss.MaxAge = time.Hour
+	ss.Clock = clock
+	m := mux.New()
+	m.Use(ss.Middleware)
+	m.Get("/").ThenFunc(func(c context.Context, w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "TOP")
+	})
+	m.Get("/set").ThenFunc(func(c context.Context, w http.ResponseWriter, r *http.Request) {
+		sessions.Session(c).Set("username", "foo")
+		fmt.Fprintf(w, "SET")
+	})
+	m.Get("/logout").ThenFunc(func(c context.Context, w http.ResponseWriter, r *http.Request) {
+		sessions.Session(c).Expire(true)
+		fmt.Fprintf(w, "LOGOUT")
+	})
+	ts := httptest.NewServer(m)
+	defer ts.Close()
+	c := newClient(t)
+	{
+		_, _, header := c.Get(t, ts.URL, "myapp_session")
+		if ok := assert.Len(t, header["Set-Cookie"], 1); ok {
+			assert.Contains(t, header["Set-Cookie"][0], "Max-Age=3600")
+			assert.Contains(t, header["Set-Cookie"][0], "Expires=Thu, 01 Jan 2015 01:00:00 GMT")
+		}
+		assert.Equal(t, time.Hour, store.ttl)
+	}
+	clock.Add(10 * time.Minute)
+	{
+		_, _, header := c.Get(t, ts.URL, "myapp_session")
+		assert.Len(t, header["Set-Cookie"], 0)
+	}
+	{
+		// the write renews the store lifetime, the cookie follows
+		_, _, header := c.Get(t, ts.URL+"/set", "myapp_session")
+		if ok := assert.Len(t, header["Set-Cookie"], 1); ok {
+			assert.Contains(t, header["Set-Cookie"][0], "Expires=Thu, 01 Jan 2015 01:10:00 GMT")
+		}
+	}
+	{
+		_, _, header := c.Get(t, ts.URL+"/logout", "myapp_session")
+		if ok := assert.Len(t, header["Set-Cookie"], 1); ok {
+			assert.Contains(t, header["Set-Cookie"][0], "Max-Age=0")
+		}
+	}
+}
+
+func TestSliding(t *testing.T) {
+	store := &ttlRecorder{MemoryStore: sessions.NewMemoryStore()}
+	defer func() {
+		err := store.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+	clock := newFakeClock()
+	ss := sessions.New(store, "myapp_session")
+	ss.MaxAge = time.Hour
+	ss.Sliding = true
+	ss.RefreshInterval = 5 * time.Minute
+	ss.Clock = clock
+	m := mux.New()
+	m.Use(ss.Middleware)
+	m.Get("/").ThenFunc(func(c context.Context, w http.ResponseWriter, r *http.Request) {
+		s := sessions.Session(c)
+		if !s.Exists("username") {
+			s.Set("username", "foo")
+		}
+		fmt.Fprintf(w, "TOP %v", s.HasKey())
+	})
+	ts := httptest.NewServer(m)
+	defer ts.Close()
+	c := newClient(t)
+	{
+		_, body, header := c.Get(t, ts.URL, "myapp_session")
+		assert.Equal(t, "TOP true", body)
+		assert.Len(t, header["Set-Cookie"], 1)
+		assert.Equal(t, 1, store.sets)
+	}
+	clock.Add(time.Minute)
+	{
+		_, _, header := c.Get(t, ts.URL, "myapp_session")
+		assert.Len(t, header["Set-Cookie"], 0)
+		assert.Equal(t, 1, store.sets)
+	}
+	clock.Add(5 * time.Minute)
+	{
+		_, _, header := c.Get(t, ts.URL, "myapp_session")
+		if ok := assert.Len(t, header["Set-Cookie"], 1); ok {
+			assert.Contains(t, header["Set-Cookie"][0], "Expires=Thu, 01 Jan 2015 01:06:00 GMT")
+		}
+		assert.Equal(t, 2, store.sets)
+	}
+	clock.Add(time.Minute)
+	{
+		_, _, header := c.Get(t, ts.URL, "myapp_session")
+		assert.Len(t, header["Set-Cookie"], 0)
+		assert.Equal(t, 2, store.sets)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	store := sessions.NewMemoryStore()
+	defer func() {
+		err := store.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+	clock := newFakeClock()
+	ss := sessions.New(store, "myapp_session")
+	ss.Clock = clock
+	ss.IdleTimeout = 30 * time.Minute
+	ss.AbsoluteTimeout = 2 * time.Hour
+	ss.RefreshInterval = time.Minute
+	var timedOut []string
+	ss.OnTimeout = func(c context.Context, r *http.Request, sid string) {
+		timedOut = append(timedOut, sid)
+	}
+	m := mux.New()
+	m.Use(ss.Middleware)
+	m.Get("/").ThenFunc(func(c context.Context, w http.ResponseWriter, r *http.Request) {
+		s := sessions.Session(c)
+		if s.Exists("username") {
+			fmt.Fprintf(w, "TOP: Hello %s", s.Get("username").(string))
+		} else {
+			fmt.Fprintf(w, "TOP")
+		}
+	})
+	m.Get("/login").ThenFunc(func(c context.Context, w http.ResponseWriter, r *http.Request) {
+		sessions.Session(c).Set("username", "foo")
+		fmt.Fprintf(w, "LOGIN")
+	})
+	ts := httptest.NewServer(m)
+	defer ts.Close()
+	c := newClient(t)
+	re := regexp.MustCompile("myapp_session=([a-f0-9]{40})")
+	var sid string
+	{
+		_, body, header := c.Get(t, ts.URL+"/login", "myapp_session")
+		assert.Equal(t, "LOGIN", body)
+		if ok := assert.Len(t, header["Set-Cookie"], 1); ok {
+			sid = re.FindStringSubmatch(header["Set-Cookie"][0])[1]
+		}
+	}
+	for i := 0; i < 3; i++ {
+		clock.Add(20 * time.Minute)
+		_, body, header := c.Get(t, ts.URL, "myapp_session")
+		assert.Equal(t, "TOP: Hello foo", body)
+		assert.Len(t, header["Set-Cookie"], 0)
+	}
+	clock.Add(31 * time.Minute)
+	{
+		_, body, header := c.Get(t, ts.URL, "myapp_session")
+		assert.Equal(t, "TOP", body)
+		assert.Len(t, header["Set-Cookie"], 1)
+		assert.Equal(t, []string{sid}, timedOut)
+		v, _ := store.Get(sid)
+		assert.Len(t, v, 0)
+	}
+	{
+		_, body, _ := c.Get(t, ts.URL+"/login", "myapp_session")
+		assert.Equal(t, "LOGIN", body)
+	}
+	for i := 0; i < 6; i++ {
+		clock.Add(20 * time.Minute)
+		_, body, _ := c.Get(t, ts.URL, "myapp_session")
+		assert.Equal(t, "TOP: Hello foo", body)
+	}
+	clock.Add(20 * time.Minute)
+	{
+		_, body, _ := c.Get(t, ts.URL, "myapp_session")
+		assert.Equal(t, "TOP", body)
+		assert.Len(t, timedOut, 2)
+	}
+}
+
+func TestCookieAttributes(t *testing.T) {
+	store := sessions.NewMemoryStore()
+	defer func() {
+		err := store.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+	ss := sessions.New(store, "__Host-myapp_session")
+	ss.Path = "/"
+	ss.Secure = true
+	ss.SameSite = http.SameSiteLaxMode
+	ss.Partitioned = true
+	var handled error
+	ss.ErrorHandler = func(c context.Context, w http.ResponseWriter, r *http.Request, err error) {
+		handled = err
+	}
+	m := mux.New()
+	m.Use(ss.Middleware)
+	m.Get("/").ThenFunc(func(c context.Context, w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "TOP")
+	})
+	m.Get("/strict").ThenFunc(func(c context.Context, w http.ResponseWriter, r *http.Request) {
+		o := sessions.Session(c).Options()
+		o.SameSite = http.SameSiteStrictMode
+		o.Partitioned = false
+		fmt.Fprintf(w, "STRICT")
+	})
+	m.Get("/domain").ThenFunc(func(c context.Context, w http.ResponseWriter, r *http.Request) {
+		sessions.Session(c).Options().Domain = "example.com"
+	})
+	ts := httptest.NewServer(m)
+	defer ts.Close()
+	c := newClient(t)
+	{
+		_, _, header := c.Get(t, ts.URL, "__Host-myapp_session")
+		if ok := assert.Len(t, header["Set-Cookie"], 1); ok {
+			assert.Contains(t, header["Set-Cookie"][0], "; SameSite=Lax")
+			assert.Contains(t, header["Set-Cookie"][0], "; Partitioned")
+		}
+	}
+	{
+		_, _, header := newClient(t).Get(t, ts.URL+"/strict", "__Host-myapp_session")
+		if ok := assert.Len(t, header["Set-Cookie"], 1); ok {
+			assert.Contains(t, header["Set-Cookie"][0], "; SameSite=Strict")
+			assert.NotContains(t, header["Set-Cookie"][0], "; Partitioned")
+		}
+	}
+	{
+		_, _, header := c.Get(t, ts.URL+"/domain", "__Host-myapp_session")
+		assert.Len(t, header["Set-Cookie"], 0)
+		assert.True(t, errors.Is(handled, sessions.ErrInvalidConfig))
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		setup func(ss *sessions.Sessions)
+		valid bool
+	}{
+		{"myapp_session", func(ss *sessions.Sessions) {}, true},
+		{"__Secure-myapp_session", func(ss *sessions.Sessions) {}, false},
+		{"__Secure-myapp_session", func(ss *sessions.Sessions) { ss.Secure = true }, true},
+		{"__Host-myapp_session", func(ss *sessions.Sessions) { ss.Secure = true }, false},
+		{"__Host-myapp_session", func(ss *sessions.Sessions) { ss.Secure, ss.Path = true, "/" }, true},
+		{"__Host-myapp_session", func(ss *sessions.Sessions) { ss.Secure, ss.Path, ss.Domain = true, "/", "example.com" }, false},
+		{"myapp_session", func(ss *sessions.Sessions) { ss.SameSite = http.SameSiteNoneMode }, false},
+		{"myapp_session", func(ss *sessions.Sessions) { ss.SameSite, ss.Secure = http.SameSiteNoneMode, true }, true},
+		{"myapp_session", func(ss *sessions.Sessions) { ss.Partitioned = true }, false},
+	} {
+		ss := sessions.New(sessions.NewMemoryStore(), tc.name)
+		tc.setup(ss)
+		err := ss.Validate()
+		if tc.valid {
+			assert.NoError(t, err, tc.name)
+		} else {
+			assert.True(t, errors.Is(err, sessions.ErrInvalidConfig), tc.name)
+			assert.Panics(t, func() { ss.Middleware(nil) }, tc.name)
+		}
+	}
+}
+
+func greet(s sessions.SessionData) string {
+	if s.Exists("username") {
+		return fmt.Sprintf("Hello %s", s.Get("username"))
+	}
+	s.Options().MaxAge = time.Hour
+	s.Set("username", "foo")
+	return "Welcome"
+}
+
+type stubSession struct {
+	sessions.SessionData
+	values  map[string]interface{}
+	options sessions.CookieOptions
+}
+
+func (ss *stubSession) Exists(key string) bool {
+	_, ok := ss.values[key]
+	return ok
+}
+
+func (ss *stubSession) Get(key string) interface{} {
+	return ss.values[key]
+}
+
+func (ss *stubSession) Set(key string, val interface{}) {
+	ss.values[key] = val
+}
+
+func (ss *stubSession) Options() *sessions.CookieOptions {
+	return &ss.options
+}
+
+func TestFromContext(t *testing.T) {
+	{
+		s, ok := sessions.FromContext(context.Background())
+		assert.False(t, ok)
+		assert.Nil(t, s)
+	}
+	{
+		stub := &stubSession{values: map[string]interface{}{}}
+		assert.Equal(t, "Welcome", greet(stub))
+		assert.Equal(t, time.Hour, stub.options.MaxAge)
+		assert.Equal(t, "Hello foo", greet(stub))
+	}
+	store := sessions.NewMemoryStore()
+	defer func() {
+		err := store.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+	ss := sessions.New(store, "myapp_session")
+	m := mux.New()
+	m.Use(ss.Middleware)
+	m.Get("/").ThenFunc(func(c context.Context, w http.ResponseWriter, r *http.Request) {
+		s, ok := sessions.FromContext(c)
+		if !ok {
+			http.Error(w, "no session", http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, greet(s))
+	})
+	ts := httptest.NewServer(m)
+	defer ts.Close()
+	c := newClient(t)
+	{
+		_, body, header := c.Get(t, ts.URL, "myapp_session")
+		assert.Equal(t, "Welcome", body)
+		if ok := assert.Len(t, header["Set-Cookie"], 1); ok {
+			assert.Contains(t, header["Set-Cookie"][0], "Max-Age=3600")
+		}
+	}
+	{
+		_, body, _ := c.Get(t, ts.URL, "myapp_session")
+		assert.Equal(t, "Hello foo", body)
+	}
+}
+
+func TestMultipleSessions(t *testing.T) {
+	store := sessions.NewMemoryStore()
+	defer func() {
+		err := store.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+	auth := sessions.New(store, "auth_session")
+	prefs := sessions.New(store, "prefs_session")
+	m := mux.New()
+	m.Use(auth.Middleware)
+	m.Use(prefs.Middleware)
+	m.Get("/").ThenFunc(func(c context.Context, w http.ResponseWriter, r *http.Request) {
+		a, _ := auth.Get(c)
+		p, _ := prefs.Get(c)
+		if !a.Exists("username") {
+			a.Set("username", "foo")
+			p.Set("theme", "dark")
+		}
+		fmt.Fprintf(w, "%v %v %v", a.Get("username"), p.Get("theme"), sessions.Session(c).Exists("theme"))
+	})
+	ts := httptest.NewServer(m)
+	defer ts.Close()
+	c := newClient(t)
+	{
+		_, body, header := c.Get(t, ts.URL, "auth_session")
+		assert.Equal(t, "foo dark true", body)
+		assert.Len(t, header["Set-Cookie"], 2)
+	}
+	{
+		_, body, header := c.Get(t, ts.URL, "auth_session")
+		assert.Equal(t, "foo dark true", body)
+		assert.Len(t, header["Set-Cookie"], 0)
+	}
+	{
+		s, ok := auth.Get(context.Background())
+		assert.False(t, ok)
+		assert.Nil(t, s)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	store := sessions.NewMemoryStore()
+	defer func() {
+		err := store.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+	ss := sessions.New(store, "myapp_session")
+	counter := func(s sessions.SessionData) int {
+		v := 1
+		if s.Exists("counter") {
+			v = s.Get("counter").(int) + 1
+		}
+		s.Set("counter", v)
+		return v
+	}
+	std := http.NewServeMux()
+	std.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		s := sessions.Session(r.Context())
+		fmt.Fprintf(w, "counter=>%d", counter(s))
+	})
+	m := mux.New()
+	m.Use(ss.Middleware)
+	m.Get("/").ThenFunc(func(c context.Context, w http.ResponseWriter, r *http.Request) {
+		s, _ := ss.Get(c)
+		fmt.Fprintf(w, "counter=>%d", counter(s))
+	})
+	stdServer := httptest.NewServer(ss.Handler(std))
+	defer stdServer.Close()
+	feverServer := httptest.NewServer(m)
+	defer feverServer.Close()
+	c := newClient(t)
+	re := regexp.MustCompile("myapp_session=([a-f0-9]{40})")
+	var sid string
+	{
+		_, body, header := c.Get(t, stdServer.URL, "myapp_session")
+		assert.Equal(t, "counter=>1", body)
+		if ok := assert.Len(t, header["Set-Cookie"], 1); ok {
+			sid = re.FindStringSubmatch(header["Set-Cookie"][0])[1]
+		}
+	}
+	{
+		_, body, header := c.Get(t, stdServer.URL, "myapp_session")
+		assert.Equal(t, "counter=>2", body)
+		assert.Len(t, header["Set-Cookie"], 0)
+	}
+	{
+		req, _ := http.NewRequest("GET", feverServer.URL, nil)
+		req.AddCookie(&http.Cookie{Name: "myapp_session", Value: sid})
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		assert.Equal(t, "counter=>3", string(body))
+	}
+}
+
+func TestCheckConflicts(t *testing.T) {
+	store := sessions.NewMemoryStore()
+	defer func() {
+		err := store.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+	ss := sessions.New(store, "myapp_session")
+	ss.CheckConflicts = true
+	errs := make(chan error, 1)
+	ss.ErrorHandler = func(c context.Context, w http.ResponseWriter, r *http.Request, err error) {
+		errs <- err
+	}
+	loaded := make(chan struct{})
+	release := make(chan struct{})
+	m := mux.New()
+	m.Use(ss.Middleware)
+	m.Get("/").ThenFunc(func(c context.Context, w http.ResponseWriter, r *http.Request) {
+		s := sessions.Session(c)
+		s.Set("init", true)
+		fmt.Fprint(w, "TOP")
+	})
+	m.Get("/slow").ThenFunc(func(c context.Context, w http.ResponseWriter, r *http.Request) {
+		s := sessions.Session(c)
+		s.Set("slow", true)
+		loaded <- struct{}{}
+		<-release
+		fmt.Fprint(w, "SLOW")
+	})
+	m.Get("/fast").ThenFunc(func(c context.Context, w http.ResponseWriter, r *http.Request) {
+		s := sessions.Session(c)
+		s.Set("fast", true)
+		fmt.Fprint(w, "FAST")
+	})
+	m.Get("/logout").ThenFunc(func(c context.Context, w http.ResponseWriter, r *http.Request) {
+		sessions.Session(c).Expire(true)
+		fmt.Fprint(w, "LOGOUT")
+	})
+	m.Get("/keys").ThenFunc(func(c context.Context, w http.ResponseWriter, r *http.Request) {
+		s := sessions.Session(c)
+		fmt.Fprintf(w, "init=%v slow=%v fast=%v", s.Exists("init"), s.Exists("slow"), s.Exists("fast"))
+	})
+	ts := httptest.NewServer(m)
+	defer ts.Close()
+
+	race := func(c *client, path string) {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			c.Get(t, ts.URL+"/slow", "myapp_session")
+		}()
+		<-loaded
+		c.Get(t, ts.URL+path, "myapp_session")
+		close(release)
+		<-done
+		release = make(chan struct{})
+	}
+
+	{
+		c := newClient(t)
+		c.Get(t, ts.URL, "myapp_session")
+		race(c, "/fast")
+		select {
+		case err := <-errs:
+			assert.True(t, errors.Is(err, sessions.ErrConflict))
+		default:
+			t.Fatal("conflict was not reported")
+		}
+		_, body, _ := c.Get(t, ts.URL+"/keys", "myapp_session")
+		assert.Equal(t, "init=true slow=false fast=true", body)
+	}
+
+	ss.Merge = func(stored, local map[string]interface{}) map[string]interface{} {
+		for k, v := range local {
+			stored[k] = v
+		}
+		return stored
+	}
+	{
+		c := newClient(t)
+		c.Get(t, ts.URL, "myapp_session")
+		race(c, "/fast")
+		select {
+		case err := <-errs:
+			t.Fatal(err)
+		default:
+		}
+		_, body, _ := c.Get(t, ts.URL+"/keys", "myapp_session")
+		assert.Equal(t, "init=true slow=true fast=true", body)
+	}
+	// a session deleted meanwhile is not merged back to life
+	{
+		c := newClient(t)
+		c.Get(t, ts.URL, "myapp_session")
+		n := store.Len()
+		race(c, "/logout")
+		select {
+		case err := <-errs:
+			assert.True(t, errors.Is(err, sessions.ErrConflict))
+		default:
+			t.Fatal("conflict was not reported")
+		}
+		assert.Equal(t, n-1, store.Len())
+	}
+}
+
+func TestMergeOnWrite(t *testing.T) {
+	store := sessions.NewMemoryStore()
+	defer func() {
+		err := store.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+	ss := sessions.New(store, "myapp_session")
+	loaded := make(chan struct{})
+	release := make(chan struct{})
+	m := mux.New()
+	m.Use(ss.Middleware)
+	m.Get("/").ThenFunc(func(c context.Context, w http.ResponseWriter, r *http.Request) {
+		s := sessions.Session(c)
+		s.Set("init", true)
+		s.AddFlash("hello")
+		fmt.Fprint(w, "TOP")
+	})
+	m.Get("/slow").ThenFunc(func(c context.Context, w http.ResponseWriter, r *http.Request) {
+		s := sessions.Session(c)
+		s.Set("slow", true)
+		s.Del("init")
+		loaded <- struct{}{}
+		<-release
+		fmt.Fprint(w, "SLOW")
+	})
+	m.Get("/fast").ThenFunc(func(c context.Context, w http.ResponseWriter, r *http.Request) {
+		s := sessions.Session(c)
+		s.Set("fast", true)
+		fmt.Fprintf(w, "FAST%v", s.Flashes())
+	})
+	m.Get("/logout").ThenFunc(func(c context.Context, w http.ResponseWriter, r *http.Request) {
+		sessions.Session(c).Expire(true)
+		fmt.Fprint(w, "LOGOUT")
+	})
+	m.Get("/keys").ThenFunc(func(c context.Context, w http.ResponseWriter, r *http.Request) {
+		s := sessions.Session(c)
+		fmt.Fprintf(w, "init=%v slow=%v fast=%v flash=%v", s.Exists("init"), s.Exists("slow"), s.Exists("fast"), s.Flashes())
+	})
+	ts := httptest.NewServer(m)
+	defer ts.Close()
+	c := newClient(t)
+	c.Get(t, ts.URL, "myapp_session")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.Get(t, ts.URL+"/slow", "myapp_session")
+	}()
+	<-loaded
+	c.Get(t, ts.URL+"/fast", "myapp_session")
+	close(release)
+	<-done
+	{
+		_, body, _ := c.Get(t, ts.URL+"/keys", "myapp_session")
+		assert.Equal(t, "init=false slow=true fast=true flash=[]", body)
+	}
+
+	// a session deleted meanwhile is not written back
+	release = make(chan struct{})
+	done = make(chan struct{})
+	go func() {
+		defer close(done)
+		c.Get(t, ts.URL+"/slow", "myapp_session")
+	}()
+	<-loaded
+	c.Get(t, ts.URL+"/logout", "myapp_session")
+	close(release)
+	<-done
+	assert.Equal(t, 0, store.Len())
+}
+
+func TestRedisHashStoreSession(t *testing.T) {
+	server, err := redistest.NewServer(true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	store, err := sessions.NewRedisHashStore("unix", server.Config["unixsocket"], "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	conn, err := redis.Dial("unix", server.Config["unixsocket"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ss := sessions.New(store, "myapp_session")
+	ss.Codec = sessions.JSONCodec{}
+	m := mux.New()
+	m.Use(ss.Middleware)
+	m.Get("/").ThenFunc(func(c context.Context, w http.ResponseWriter, r *http.Request) {
+		s := sessions.Session(c)
+		s.Set("user", "foo")
+		fmt.Fprint(w, "TOP")
+	})
+	m.Get("/visit").ThenFunc(func(c context.Context, w http.ResponseWriter, r *http.Request) {
+		s := sessions.Session(c)
+		s.Set("page", r.URL.Query().Get("page"))
+		fmt.Fprintf(w, "user=%v page=%v", s.Get("user"), s.Get("page"))
+	})
+	m.Get("/logout").ThenFunc(func(c context.Context, w http.ResponseWriter, r *http.Request) {
+		s := sessions.Session(c)
+		s.Del("user")
+		fmt.Fprint(w, "BYE")
+	})
+	m.Get("/empty").ThenFunc(func(c context.Context, w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "EMPTY")
+	})
+	// another request deletes the session while this one runs
+	var vanish string
+	m.Get("/vanish").ThenFunc(func(c context.Context, w http.ResponseWriter, r *http.Request) {
+		conn.Do("DEL", vanish)
+		sessions.Session(c).Set("page", "vanish")
+		fmt.Fprint(w, "VANISH")
+	})
+	ts := httptest.NewServer(m)
+	defer ts.Close()
+	c := newClient(t)
+	re := regexp.MustCompile("myapp_session=([a-f0-9]{40})")
+	var sid string
+	{
+		_, body, header := c.Get(t, ts.URL, "myapp_session")
+		assert.Equal(t, "TOP", body)
+		if ok := assert.Len(t, header["Set-Cookie"], 1); ok {
+			sid = re.FindStringSubmatch(header["Set-Cookie"][0])[1]
+		}
+		v, _ := redis.String(conn.Do("HGET", sid, "user"))
+		assert.Equal(t, `"foo"`, v)
+	}
+	// a write from elsewhere survives a request that changed another key
+	conn.Do("HSET", sid, "user", `"bar"`)
+	{
+		_, body, _ := c.Get(t, ts.URL+"/visit?page=top", "myapp_session")
+		assert.Equal(t, "user=bar page=top", body)
+		v, _ := redis.String(conn.Do("HGET", sid, "user"))
+		assert.Equal(t, `"bar"`, v)
+		v, _ = redis.String(conn.Do("HGET", sid, "page"))
+		assert.Equal(t, `"top"`, v)
+	}
+	{
+		c.Get(t, ts.URL+"/logout", "myapp_session")
+		ok, _ := redis.Bool(conn.Do("HEXISTS", sid, "user"))
+		assert.False(t, ok)
+		_, body, _ := c.Get(t, ts.URL+"/visit?page=next", "myapp_session")
+		assert.Equal(t, "user=<nil> page=next", body)
+	}
+	{
+		_, _, header := newClient(t).Get(t, ts.URL+"/empty", "myapp_session")
+		if ok := assert.Len(t, header["Set-Cookie"], 1); ok {
+			sid := re.FindStringSubmatch(header["Set-Cookie"][0])[1]
+			ok, _ := redis.Bool(conn.Do("EXISTS", sid))
+			assert.True(t, ok)
+		}
+	}
+	{
+		vanish = sid
+		_, body, _ := c.Get(t, ts.URL+"/vanish", "myapp_session")
+		assert.Equal(t, "VANISH", body)
+		ok, _ := redis.Bool(conn.Do("EXISTS", sid))
+		assert.False(t, ok)
+	}
+}
+
+func TestHijack(t *testing.T) {
+	store := sessions.NewMemoryStore()
+	defer func() {
+		err := store.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+	ss := sessions.New(store, "myapp_session")
+	hijack := func(w http.ResponseWriter) {
+		_, ok := w.(http.CloseNotifier)
+		assert.True(t, ok)
+		h, ok := w.(http.Hijacker)
+		if !assert.True(t, ok) {
+			return
+		}
+		conn, rw, err := h.Hijack()
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 8\r\nConnection: close\r\n\r\nHIJACKED")
+		rw.Flush()
+	}
+	std := http.NewServeMux()
+	std.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		sessions.Session(r.Context()).Set("hijacked", true)
+		hijack(w)
+	})
+	m := mux.New()
+	m.Use(ss.Middleware)
+	m.Get("/").ThenFunc(func(c context.Context, w http.ResponseWriter, r *http.Request) {
+		sessions.Session(c).Set("hijacked", true)
+		hijack(w)
+	})
+	for _, h := range []http.Handler{ss.Handler(std), m} {
+		ts := httptest.NewServer(h)
+		n := store.Len()
+		_, body, _ := newClient(t).Get(t, ts.URL, "myapp_session")
+		assert.Equal(t, "HIJACKED", body)
+		// saved before the connection was taken over
+		assert.Equal(t, n+1, store.Len())
+		ts.Close()
+	}
+}
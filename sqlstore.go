@@ -0,0 +1,142 @@
+package sessions
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+type SQLDialect int
+
+const (
+	SQLite SQLDialect = iota
+	PostgreSQL
+)
+
+func (d SQLDialect) placeholder(n int) string {
+	if d == PostgreSQL {
+		return fmt.Sprintf("$%d", n)
+	}
+	return "?"
+}
+
+func (d SQLDialect) schema(table string) []string {
+	blob, integer := "BLOB", "INTEGER"
+	if d == PostgreSQL {
+		blob, integer = "BYTEA", "BIGINT"
+	}
+	return []string{
+		fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (id TEXT PRIMARY KEY, data %s NOT NULL, expires_at %s NOT NULL DEFAULT 0)", table, blob, integer),
+		fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s_expires_at ON %s (expires_at)", table, table),
+	}
+}
+
+var sqlTableName = regexp.MustCompile(`\A[A-Za-z_][A-Za-z0-9_]*\z`)
+
+const defaultSQLTable = "sessions"
+
+// SQLSchema returns the statements creating the session table, for use in a
+// migration when the store is opened WithoutCreateTable
+func SQLSchema(dialect SQLDialect, table string) string {
+	if table == "" {
+		table = defaultSQLTable
+	}
+	return strings.Join(dialect.schema(table), ";\n") + ";\n"
+}
+
+// SQLStore keeps sessions in a table of id, data and expires_at, the latter
+// in unix seconds with 0 for no expiry. The *sql.DB is not closed by Close.
+type SQLStore struct {
+	db      *sql.DB
+	dialect SQLDialect
+	table   string
+	clock   Clock
+	janitor *janitor
+
+	get, set, del, deleteExpired string
+}
+
+func NewSQLStore(db *sql.DB, dialect SQLDialect, table string, opts ...StoreOption) (*SQLStore, error) {
+	if table == "" {
+		table = defaultSQLTable
+	}
+	if !sqlTableName.MatchString(table) {
+		return nil, wrapError(ErrInvalidConfig, fmt.Errorf("bad table name %q", table))
+	}
+	o := newStoreOptions(opts)
+	p := dialect.placeholder
+	st := &SQLStore{
+		db:            db,
+		dialect:       dialect,
+		table:         table,
+		clock:         o.clock,
+		get:           fmt.Sprintf("SELECT data FROM %s WHERE id = %s AND (expires_at = 0 OR %s < expires_at)", table, p(1), p(2)),
+		set:           fmt.Sprintf("INSERT INTO %s (id, data, expires_at) VALUES (%s, %s, %s) ON CONFLICT (id) DO UPDATE SET data = excluded.data, expires_at = excluded.expires_at", table, p(1), p(2), p(3)),
+		del:           fmt.Sprintf("DELETE FROM %s WHERE id = %s", table, p(1)),
+		deleteExpired: fmt.Sprintf("DELETE FROM %s WHERE expires_at <> 0 AND expires_at <= %s", table, p(1)),
+	}
+	if !o.skipCreateTable {
+		if err := st.CreateTable(); err != nil {
+			return nil, err
+		}
+	}
+	st.janitor = startJanitor(o, st.GC)
+	return st, nil
+}
+
+// CreateTable creates the session table unless it exists
+func (st *SQLStore) CreateTable() error {
+	for _, q := range st.dialect.schema(st.table) {
+		if _, err := st.db.Exec(q); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (st *SQLStore) Close() error {
+	st.janitor.Stop()
+	return nil
+}
+
+// DeleteExpired removes expired rows and reports how many were removed
+func (st *SQLStore) DeleteExpired() (int64, error) {
+	res, err := st.db.Exec(st.deleteExpired, st.clock.Now().Unix())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (st *SQLStore) GC() {
+	st.DeleteExpired()
+}
+
+func (st *SQLStore) Get(key string) ([]byte, error) {
+	var b []byte
+	err := st.db.QueryRow(st.get, key, st.clock.Now().Unix()).Scan(&b)
+	if err == sql.ErrNoRows {
+		return []byte(nil), nil
+	}
+	return b, err
+}
+
+func (st *SQLStore) Set(key string, val []byte) error {
+	return st.SetWithTTL(key, val, 0)
+}
+
+func (st *SQLStore) SetWithTTL(key string, val []byte, ttl time.Duration) error {
+	var expires int64
+	if 0 < ttl {
+		expires = st.clock.Now().Unix() + ttlSeconds(ttl)
+	}
+	_, err := st.db.Exec(st.set, key, val, expires)
+	return err
+}
+
+func (st *SQLStore) Del(key string) error {
+	_, err := st.db.Exec(st.del, key)
+	return err
+}
@@ -0,0 +1,128 @@
+package sessions_test
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/mix3/fever-sessions"
+	"github.com/stretchr/testify/assert"
+)
+
+func newSQLite(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every connection to :memory: is a database of its own
+	db.SetMaxOpenConns(1)
+	return db
+}
+
+func TestSQLStore(t *testing.T) {
+	db := newSQLite(t)
+	defer db.Close()
+	fc := newFakeClock()
+	st, err := sessions.NewSQLStore(db, sessions.SQLite, "", sessions.WithClock(fc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	st.Set("hoge", []byte("fuga"))
+	{
+		v, _ := st.Get("hoge")
+		assert.Equal(t, []byte("fuga"), v)
+	}
+	st.Set("hoge", []byte("piyo"))
+	{
+		v, _ := st.Get("hoge")
+		assert.Equal(t, []byte("piyo"), v)
+	}
+	st.Del("hoge")
+	{
+		v, err := st.Get("hoge")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte(nil), v)
+	}
+	st.SetWithTTL("foo", []byte("bar"), 1500*time.Millisecond)
+	st.Set("baz", []byte("qux"))
+	{
+		var expires int64
+		db.QueryRow("SELECT expires_at FROM sessions WHERE id = 'foo'").Scan(&expires)
+		assert.Equal(t, fc.Now().Add(2*time.Second).Unix(), expires)
+	}
+	fc.Add(time.Second)
+	{
+		v, _ := st.Get("foo")
+		assert.Equal(t, []byte("bar"), v)
+	}
+	fc.Add(time.Second)
+	{
+		v, _ := st.Get("foo")
+		assert.Equal(t, []byte(nil), v)
+		n, err := st.DeleteExpired()
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), n)
+		v, _ = st.Get("baz")
+		assert.Equal(t, []byte("qux"), v)
+	}
+}
+
+func TestSQLStoreGC(t *testing.T) {
+	db := newSQLite(t)
+	defer db.Close()
+	fc := newFakeClock()
+	st, err := sessions.NewSQLStore(db, sessions.SQLite, "", sessions.WithClock(fc), sessions.WithGCInterval(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.SetWithTTL("hoge", []byte("fuga"), time.Second)
+	// expires_at stays 0 without a ttl, which DeleteExpired skips
+	st.Set("piyo", []byte("piyo"))
+	fc.Sweep(time.Minute)
+	var ids []string
+	rows, err := db.Query("SELECT id FROM sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		var id string
+		rows.Scan(&id)
+		ids = append(ids, id)
+	}
+	rows.Close()
+	assert.Equal(t, []string{"piyo"}, ids)
+	assert.NoError(t, st.Close())
+	assert.NoError(t, st.Close())
+}
+
+func TestSQLStoreSchema(t *testing.T) {
+	db := newSQLite(t)
+	defer db.Close()
+	_, err := sessions.NewSQLStore(db, sessions.SQLite, "web_sessions; DROP TABLE users")
+	assert.True(t, errors.Is(err, sessions.ErrInvalidConfig))
+
+	st, err := sessions.NewSQLStore(db, sessions.SQLite, "web_sessions", sessions.WithoutCreateTable())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	assert.Error(t, st.Set("hoge", []byte("fuga")))
+	_, err = db.Exec(sessions.SQLSchema(sessions.SQLite, "web_sessions"))
+	assert.NoError(t, err)
+	assert.NoError(t, st.Set("hoge", []byte("fuga")))
+	// opening again leaves the existing table alone
+	st2, err := sessions.NewSQLStore(db, sessions.SQLite, "web_sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st2.Close()
+	v, _ := st2.Get("hoge")
+	assert.Equal(t, []byte("fuga"), v)
+
+	assert.Equal(t, "CREATE TABLE IF NOT EXISTS sessions (id TEXT PRIMARY KEY, data BYTEA NOT NULL, expires_at BIGINT NOT NULL DEFAULT 0);\n"+
+		"CREATE INDEX IF NOT EXISTS sessions_expires_at ON sessions (expires_at);\n", sessions.SQLSchema(sessions.PostgreSQL, ""))
+}
@@ -0,0 +1,479 @@
+package sessions
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"unicode/utf8"
+)
+
+// Storable opcodes, see Storable.xs
+const (
+	sxObject        = 0
+	sxLScalar       = 1
+	sxArray         = 2
+	sxHash          = 3
+	sxRef           = 4
+	sxUndef         = 5
+	sxInteger       = 6
+	sxDouble        = 7
+	sxByte          = 8
+	sxNetint        = 9
+	sxScalar        = 10
+	sxSvUndef       = 14
+	sxSvYes         = 15
+	sxSvNo          = 16
+	sxBless         = 17
+	sxIxBless       = 18
+	sxOverload      = 20
+	sxUTF8Str       = 23
+	sxLUTF8Str      = 24
+	sxFlagHash      = 25
+	sxWeakRef       = 27
+	sxWeakOverload  = 28
+	sxVString       = 29
+	sxLVString      = 30
+	sxSvUndefElem   = 31
+	sxBooleanTrue   = 34
+	sxBooleanFalse  = 35
+	storableMajor   = 2
+	storableMinor   = 11
+	shvKeyUTF8      = 0x01
+	shvKeyIsSV      = 0x08
+	storableLongLen = 0x80
+)
+
+var ErrStorableFormat = errors.New("sessions: unsupported Storable data")
+
+// StorableCodec reads and writes the Perl Storable nfreeze format, which is
+// what Plack::Middleware::Session::Simple ends up storing through
+// Cache::Memcached::Fast, CHI and friends by default.
+//
+// Perl has no integer/string distinction on the wire: numbers that Perl kept
+// as strings decode as Go strings, doubles are always stored as strings and
+// booleans are written as 1 and 0.
+type StorableCodec struct{}
+
+func (StorableCodec) Marshal(v interface{}) ([]byte, error) {
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	if rv.Kind() != reflect.Map {
+		return nil, fmt.Errorf("%w: top level value must be a map, got %T", ErrStorableFormat, v)
+	}
+	e := &storableEncoder{}
+	e.buf.WriteByte(storableMajor<<1 | 1)
+	e.buf.WriteByte(storableMinor)
+	if err := e.encodeMap(rv); err != nil {
+		return nil, err
+	}
+	return e.buf.Bytes(), nil
+}
+
+func (StorableCodec) Unmarshal(data []byte, v interface{}) error {
+	d := &storableDecoder{data: data}
+	if len(data) < 2 {
+		return fmt.Errorf("%w: short header", ErrStorableFormat)
+	}
+	if data[0]&1 == 0 || data[0]>>1 != storableMajor {
+		return fmt.Errorf("%w: not an nfreeze image", ErrStorableFormat)
+	}
+	d.pos = 2
+	val, err := d.retrieve()
+	if err != nil {
+		return err
+	}
+	m, ok := val.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("%w: top level value is %T, not a hash", ErrStorableFormat, val)
+	}
+	switch p := v.(type) {
+	case *sessionValues:
+		*p = sessionValues(m)
+	case *map[string]interface{}:
+		*p = m
+	case *interface{}:
+		*p = m
+	default:
+		return fmt.Errorf("%w: cannot unmarshal into %T", ErrStorableFormat, v)
+	}
+	return nil
+}
+
+type storableEncoder struct {
+	buf bytes.Buffer
+}
+
+func (e *storableEncoder) writeLen(n int) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(n))
+	e.buf.Write(b[:])
+}
+
+func (e *storableEncoder) encodeString(s string) {
+	op, lop := byte(sxScalar), byte(sxLScalar)
+	if !isASCII(s) && utf8.ValidString(s) {
+		op, lop = sxUTF8Str, sxLUTF8Str
+	}
+	if len(s) <= math.MaxUint8 {
+		e.buf.WriteByte(op)
+		e.buf.WriteByte(byte(len(s)))
+	} else {
+		e.buf.WriteByte(lop)
+		e.writeLen(len(s))
+	}
+	e.buf.WriteString(s)
+}
+
+func (e *storableEncoder) encodeInt(i int64) {
+	switch {
+	case -128 <= i && i <= 127:
+		e.buf.WriteByte(sxByte)
+		e.buf.WriteByte(byte(i + 128))
+	case math.MinInt32 <= i && i <= math.MaxInt32:
+		e.buf.WriteByte(sxNetint)
+		e.writeLen(int(int32(i)))
+	default:
+		// nfreeze stringifies anything wider than 32 bits
+		e.encodeString(strconv.FormatInt(i, 10))
+	}
+}
+
+func (e *storableEncoder) encodeMap(rv reflect.Value) error {
+	if rv.Type().Key().Kind() != reflect.String {
+		return fmt.Errorf("%w: map key must be a string, got %s", ErrStorableFormat, rv.Type().Key())
+	}
+	keys := make([]string, 0, rv.Len())
+	flagged := false
+	for _, k := range rv.MapKeys() {
+		keys = append(keys, k.String())
+		if !isASCII(k.String()) {
+			flagged = true
+		}
+	}
+	sort.Strings(keys)
+	if flagged {
+		e.buf.WriteByte(sxFlagHash)
+		e.buf.WriteByte(0)
+	} else {
+		e.buf.WriteByte(sxHash)
+	}
+	e.writeLen(len(keys))
+	for _, k := range keys {
+		err := e.encode(rv.MapIndex(reflect.ValueOf(k).Convert(rv.Type().Key())))
+		if err != nil {
+			return err
+		}
+		if flagged {
+			var flags byte
+			if !isASCII(k) && utf8.ValidString(k) {
+				flags = shvKeyUTF8
+			}
+			e.buf.WriteByte(flags)
+		}
+		e.writeLen(len(k))
+		e.buf.WriteString(k)
+	}
+	return nil
+}
+
+func (e *storableEncoder) encode(rv reflect.Value) error {
+	for rv.Kind() == reflect.Interface || rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			e.buf.WriteByte(sxUndef)
+			return nil
+		}
+		rv = rv.Elem()
+	}
+	switch rv.Kind() {
+	case reflect.Invalid:
+		e.buf.WriteByte(sxUndef)
+	case reflect.String:
+		e.encodeString(rv.String())
+	case reflect.Bool:
+		if rv.Bool() {
+			e.encodeInt(1)
+		} else {
+			e.encodeInt(0)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		e.encodeInt(rv.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		u := rv.Uint()
+		if u > math.MaxInt64 {
+			e.encodeString(strconv.FormatUint(u, 10))
+		} else {
+			e.encodeInt(int64(u))
+		}
+	case reflect.Float32, reflect.Float64:
+		e.encodeString(strconv.FormatFloat(rv.Float(), 'g', -1, 64))
+	case reflect.Slice, reflect.Array:
+		if rv.Kind() == reflect.Slice && rv.Type().Elem().Kind() == reflect.Uint8 {
+			b := rv.Bytes()
+			if len(b) <= math.MaxUint8 {
+				e.buf.WriteByte(sxScalar)
+				e.buf.WriteByte(byte(len(b)))
+			} else {
+				e.buf.WriteByte(sxLScalar)
+				e.writeLen(len(b))
+			}
+			e.buf.Write(b)
+			return nil
+		}
+		e.buf.WriteByte(sxRef)
+		e.buf.WriteByte(sxArray)
+		e.writeLen(rv.Len())
+		for i := 0; i < rv.Len(); i++ {
+			if err := e.encode(rv.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		e.buf.WriteByte(sxRef)
+		return e.encodeMap(rv)
+	default:
+		return fmt.Errorf("%w: cannot marshal %s", ErrStorableFormat, rv.Type())
+	}
+	return nil
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+type storableDecoder struct {
+	data []byte
+	pos  int
+	// every retrieved value gets a tag, SX_OBJECT refers back to it
+	seen []interface{}
+}
+
+func (d *storableDecoder) byte() (byte, error) {
+	if len(d.data) <= d.pos {
+		return 0, fmt.Errorf("%w: unexpected end of data", ErrStorableFormat)
+	}
+	b := d.data[d.pos]
+	d.pos++
+	return b, nil
+}
+
+func (d *storableDecoder) bytes(n int) ([]byte, error) {
+	if n < 0 || len(d.data)-d.pos < n {
+		return nil, fmt.Errorf("%w: unexpected end of data", ErrStorableFormat)
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+func (d *storableDecoder) int32() (int32, error) {
+	b, err := d.bytes(4)
+	if err != nil {
+		return 0, err
+	}
+	return int32(binary.BigEndian.Uint32(b)), nil
+}
+
+func (d *storableDecoder) len32() (int, error) {
+	n, err := d.int32()
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("%w: negative length", ErrStorableFormat)
+	}
+	return int(n), nil
+}
+
+func (d *storableDecoder) shortOrLongLen() (int, error) {
+	b, err := d.byte()
+	if err != nil {
+		return 0, err
+	}
+	if b&storableLongLen != 0 {
+		return d.len32()
+	}
+	return int(b), nil
+}
+
+func (d *storableDecoder) tag(v interface{}) int {
+	d.seen = append(d.seen, v)
+	return len(d.seen) - 1
+}
+
+func (d *storableDecoder) str(n int) (interface{}, error) {
+	b, err := d.bytes(n)
+	if err != nil {
+		return nil, err
+	}
+	s := string(b)
+	d.tag(s)
+	return s, nil
+}
+
+func (d *storableDecoder) retrieve() (interface{}, error) {
+	op, err := d.byte()
+	if err != nil {
+		return nil, err
+	}
+	switch op {
+	case sxObject:
+		t, err := d.len32()
+		if err != nil {
+			return nil, err
+		}
+		if len(d.seen) <= t {
+			return nil, fmt.Errorf("%w: unknown object tag %d", ErrStorableFormat, t)
+		}
+		return d.seen[t], nil
+	case sxScalar, sxUTF8Str:
+		n, err := d.byte()
+		if err != nil {
+			return nil, err
+		}
+		return d.str(int(n))
+	case sxLScalar, sxLUTF8Str:
+		n, err := d.len32()
+		if err != nil {
+			return nil, err
+		}
+		return d.str(n)
+	case sxByte:
+		b, err := d.byte()
+		if err != nil {
+			return nil, err
+		}
+		v := int(b) - 128
+		d.tag(v)
+		return v, nil
+	case sxNetint:
+		n, err := d.int32()
+		if err != nil {
+			return nil, err
+		}
+		v := int(n)
+		d.tag(v)
+		return v, nil
+	case sxUndef, sxSvUndef, sxSvUndefElem:
+		d.tag(nil)
+		return nil, nil
+	case sxSvYes, sxBooleanTrue:
+		d.tag(true)
+		return true, nil
+	case sxSvNo, sxBooleanFalse:
+		d.tag(false)
+		return false, nil
+	case sxRef, sxWeakRef, sxOverload, sxWeakOverload:
+		t := d.tag(nil)
+		v, err := d.retrieve()
+		if err != nil {
+			return nil, err
+		}
+		d.seen[t] = v
+		return v, nil
+	case sxArray:
+		n, err := d.len32()
+		if err != nil {
+			return nil, err
+		}
+		if len(d.data)-d.pos < n {
+			return nil, fmt.Errorf("%w: unexpected end of data", ErrStorableFormat)
+		}
+		a := make([]interface{}, n)
+		d.tag(a)
+		for i := range a {
+			if a[i], err = d.retrieve(); err != nil {
+				return nil, err
+			}
+		}
+		return a, nil
+	case sxHash, sxFlagHash:
+		return d.retrieveHash(op == sxFlagHash)
+	case sxBless, sxIxBless:
+		// the class name is dropped, the blessed data is returned as is
+		if op == sxBless {
+			n, err := d.shortOrLongLen()
+			if err != nil {
+				return nil, err
+			}
+			if _, err := d.bytes(n); err != nil {
+				return nil, err
+			}
+		} else if _, err := d.shortOrLongLen(); err != nil {
+			return nil, err
+		}
+		return d.retrieve()
+	case sxVString, sxLVString:
+		var n int
+		if op == sxVString {
+			b, err := d.byte()
+			if err != nil {
+				return nil, err
+			}
+			n = int(b)
+		} else if n, err = d.len32(); err != nil {
+			return nil, err
+		}
+		if _, err := d.bytes(n); err != nil {
+			return nil, err
+		}
+		return d.retrieve()
+	case sxInteger, sxDouble:
+		return nil, fmt.Errorf("%w: native number in a network order image", ErrStorableFormat)
+	}
+	return nil, fmt.Errorf("%w: opcode %d", ErrStorableFormat, op)
+}
+
+func (d *storableDecoder) retrieveHash(flagged bool) (interface{}, error) {
+	if flagged {
+		if _, err := d.byte(); err != nil {
+			return nil, err
+		}
+	}
+	n, err := d.len32()
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]interface{})
+	d.tag(m)
+	for i := 0; i < n; i++ {
+		v, err := d.retrieve()
+		if err != nil {
+			return nil, err
+		}
+		var flags byte
+		if flagged {
+			if flags, err = d.byte(); err != nil {
+				return nil, err
+			}
+		}
+		var key string
+		if flags&shvKeyIsSV != 0 {
+			k, err := d.retrieve()
+			if err != nil {
+				return nil, err
+			}
+			key = fmt.Sprint(k)
+		} else {
+			kl, err := d.len32()
+			if err != nil {
+				return nil, err
+			}
+			b, err := d.bytes(kl)
+			if err != nil {
+				return nil, err
+			}
+			key = string(b)
+		}
+		m[key] = v
+	}
+	return m, nil
+}
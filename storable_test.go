@@ -0,0 +1,92 @@
+package sessions_test
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/mix3/fever-sessions"
+	"github.com/stretchr/testify/assert"
+)
+
+// generated with: perl -MStorable=nfreeze -e '$Storable::canonical=1; print unpack("H*", nfreeze({...}))'
+var storableFixtures = map[string]string{
+	"canonical": "050b0300000006090001117000000003626967088300000007636f756e7465720402000000020a04686f67650a046675676100000005666c617368087b000000036e6567040300000001050000000161000000066e65737465640a03666f6f00000008757365726e616d65",
+	"utf8":      "050b1900000000011703e298ba0100000003e298ba",
+	// bless({a => 1}, "Foo")
+	"blessed": "050b1103466f6f030000000108810000000161",
+	// my $x = [1]; {a => $x, b => $x}
+	"shared": "050b0300000002040200000001088100000001620400000000020000000161",
+}
+
+func decodeFixture(t *testing.T, name string) map[string]interface{} {
+	b, err := hex.DecodeString(storableFixtures[name])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v map[string]interface{}
+	if err := (sessions.StorableCodec{}).Unmarshal(b, &v); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestStorableCodecUnmarshal(t *testing.T) {
+	assert.Equal(t, map[string]interface{}{
+		"username": "foo",
+		"counter":  3,
+		"big":      70000,
+		"neg":      -5,
+		"flash":    []interface{}{"hoge", "fuga"},
+		"nested":   map[string]interface{}{"a": nil},
+	}, decodeFixture(t, "canonical"))
+	assert.Equal(t, map[string]interface{}{"☺": "☺"}, decodeFixture(t, "utf8"))
+	assert.Equal(t, map[string]interface{}{"a": 1}, decodeFixture(t, "blessed"))
+	assert.Equal(t, map[string]interface{}{
+		"a": []interface{}{1},
+		"b": []interface{}{1},
+	}, decodeFixture(t, "shared"))
+
+	var v map[string]interface{}
+	assert.Error(t, (sessions.StorableCodec{}).Unmarshal([]byte("\x05\x0b\x03\x00\x00\x00\x01"), &v))
+	assert.Error(t, (sessions.StorableCodec{}).Unmarshal([]byte("pst0"), &v))
+}
+
+func TestStorableCodecMarshal(t *testing.T) {
+	codec := sessions.StorableCodec{}
+	{
+		b, err := codec.Marshal(map[string]interface{}{
+			"username": "foo",
+			"counter":  3,
+			"big":      int64(70000),
+			"neg":      -5,
+			"flash":    []interface{}{"hoge", "fuga"},
+			"nested":   map[string]interface{}{"a": nil},
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, storableFixtures["canonical"], hex.EncodeToString(b))
+	}
+	{
+		b, err := codec.Marshal(map[string]interface{}{"☺": "☺"})
+		assert.NoError(t, err)
+		assert.Equal(t, storableFixtures["utf8"], hex.EncodeToString(b))
+	}
+	{
+		b, err := codec.Marshal(map[string]interface{}{
+			"float": 1.5,
+			"wide":  int64(12345678901),
+			"bool":  true,
+		})
+		assert.NoError(t, err)
+		var v map[string]interface{}
+		assert.NoError(t, codec.Unmarshal(b, &v))
+		assert.Equal(t, map[string]interface{}{
+			"float": "1.5",
+			"wide":  "12345678901",
+			"bool":  1,
+		}, v)
+	}
+	{
+		_, err := codec.Marshal(map[string]interface{}{"ch": make(chan int)})
+		assert.Error(t, err)
+	}
+}
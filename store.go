@@ -1,8 +1,20 @@
 package sessions
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
 	"io"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/garyburd/redigo/redis"
 )
@@ -14,38 +26,231 @@ type Store interface {
 	Del(key string) error
 }
 
+type TTLStore interface {
+	Store
+	SetWithTTL(key string, val []byte, ttl time.Duration) error
+}
+
+// ttlSeconds converts a positive ttl into the whole seconds most backends
+// take, round up so a short ttl never means "no expiry"
+func ttlSeconds(ttl time.Duration) int64 {
+	return int64((ttl + time.Second - 1) / time.Second)
+}
+
+// VersionedStore supports optimistic concurrency. Versions are opaque, an
+// empty version stands for a missing key.
+type VersionedStore interface {
+	Store
+	GetVersion(key string) ([]byte, string, error)
+	CompareAndSet(key string, val []byte, version string, ttl time.Duration) (bool, error)
+}
+
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+type storeOptions struct {
+	gcInterval      time.Duration
+	clock           Clock
+	skipCreateTable bool
+	invalidator     Invalidator
+}
+
+type StoreOption func(*storeOptions)
+
+func WithGCInterval(d time.Duration) StoreOption {
+	return func(o *storeOptions) {
+		o.gcInterval = d
+	}
+}
+
+func WithClock(c Clock) StoreOption {
+	return func(o *storeOptions) {
+		o.clock = c
+	}
+}
+
+// WithoutCreateTable leaves the schema to a migration, see SQLSchema
+func WithoutCreateTable() StoreOption {
+	return func(o *storeOptions) {
+		o.skipCreateTable = true
+	}
+}
+
+// WithInvalidator lets a TieredStore tell other nodes about its writes
+func WithInvalidator(inv Invalidator) StoreOption {
+	return func(o *storeOptions) {
+		o.invalidator = inv
+	}
+}
+
+func newStoreOptions(opts []StoreOption) storeOptions {
+	o := storeOptions{clock: realClock{}}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+type janitor struct {
+	stop chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+func startJanitor(o storeOptions, gc func()) *janitor {
+	if o.gcInterval <= 0 {
+		return nil
+	}
+	j := &janitor{
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go func() {
+		defer close(j.done)
+		for {
+			select {
+			case <-o.clock.After(o.gcInterval):
+				gc()
+			case <-j.stop:
+				return
+			}
+		}
+	}()
+	return j
+}
+
+func (j *janitor) Stop() {
+	if j == nil {
+		return
+	}
+	j.once.Do(func() {
+		close(j.stop)
+		<-j.done
+	})
+}
+
+type memoryEntry struct {
+	val     []byte
+	expires time.Time
+	version uint64
+}
+
+func (e memoryEntry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && !now.Before(e.expires)
+}
+
 type MemoryStore struct {
 	sync.RWMutex
-	values map[string][]byte
+	values  map[string]memoryEntry
+	version uint64
+	clock   Clock
+	janitor *janitor
 }
 
-func NewMemoryStore() *MemoryStore {
-	return &MemoryStore{values: make(map[string][]byte)}
+func NewMemoryStore(opts ...StoreOption) *MemoryStore {
+	o := newStoreOptions(opts)
+	ms := &MemoryStore{
+		values: make(map[string]memoryEntry),
+		clock:  o.clock,
+	}
+	ms.janitor = startJanitor(o, ms.GC)
+	return ms
 }
 
 var DefaultMemoryStore = NewMemoryStore()
 
 func (ms *MemoryStore) Close() error {
+	ms.janitor.Stop()
+	ms.Lock()
+	defer ms.Unlock()
 	ms.values = nil
 	return nil
 }
 
+func (ms *MemoryStore) GC() {
+	ms.Lock()
+	defer ms.Unlock()
+	now := ms.clock.Now()
+	for k, e := range ms.values {
+		if e.expired(now) {
+			delete(ms.values, k)
+		}
+	}
+}
+
+func (ms *MemoryStore) Len() int {
+	ms.RLock()
+	defer ms.RUnlock()
+	return len(ms.values)
+}
+
 func (ms *MemoryStore) Get(key string) ([]byte, error) {
 	ms.RLock()
 	defer ms.RUnlock()
-	if v, ok := ms.values[key]; ok {
-		return v, nil
+	if e, ok := ms.values[key]; ok && !e.expired(ms.clock.Now()) {
+		return e.val, nil
 	}
 	return []byte(nil), nil
 }
 
 func (ms *MemoryStore) Set(key string, val []byte) error {
+	return ms.SetWithTTL(key, val, 0)
+}
+
+func (ms *MemoryStore) SetWithTTL(key string, val []byte, ttl time.Duration) error {
 	ms.Lock()
 	defer ms.Unlock()
-	ms.values[key] = val
+	ms.set(key, val, ttl)
 	return nil
 }
 
+func (ms *MemoryStore) set(key string, val []byte, ttl time.Duration) {
+	ms.version++
+	e := memoryEntry{val: val, version: ms.version}
+	if 0 < ttl {
+		e.expires = ms.clock.Now().Add(ttl)
+	}
+	ms.values[key] = e
+}
+
+func (ms *MemoryStore) currentVersion(key string) string {
+	if e, ok := ms.values[key]; ok && !e.expired(ms.clock.Now()) {
+		return strconv.FormatUint(e.version, 10)
+	}
+	return ""
+}
+
+func (ms *MemoryStore) GetVersion(key string) ([]byte, string, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+	if e, ok := ms.values[key]; ok && !e.expired(ms.clock.Now()) {
+		return e.val, strconv.FormatUint(e.version, 10), nil
+	}
+	return []byte(nil), "", nil
+}
+
+func (ms *MemoryStore) CompareAndSet(key string, val []byte, version string, ttl time.Duration) (bool, error) {
+	ms.Lock()
+	defer ms.Unlock()
+	if ms.currentVersion(key) != version {
+		return false, nil
+	}
+	ms.set(key, val, ttl)
+	return true, nil
+}
+
 func (ms *MemoryStore) Del(key string) error {
 	ms.Lock()
 	defer ms.Unlock()
@@ -53,31 +258,211 @@ func (ms *MemoryStore) Del(key string) error {
 	return nil
 }
 
-type RedisStore struct {
-	conn redis.Conn
+// CookieStore keeps the encoded session in the cookie value itself, sealed
+// with AES-GCM together with the time it was sealed and bound to the cookie
+// name. The first secret encrypts, all of them are tried on read so secrets
+// can be rotated. Set and Del are no-ops, Sessions calls Seal and Open instead.
+type CookieStore struct {
+	aeads []cipher.AEAD
+	// MaxAge rejects values sealed longer ago, so a captured cookie cannot be
+	// replayed forever. It defaults to defaultCookieStoreMaxAge, zero accepts
+	// any age. Values are resealed whenever the session is written.
+	MaxAge time.Duration
+	Clock  Clock
 }
 
-func NewRedisStore(network, address, password string) (*RedisStore, error) {
-	c, err := redis.Dial(network, address)
-	if err != nil {
-		return nil, err
+const defaultCookieStoreMaxAge = 7 * 24 * time.Hour
+
+func NewCookieStore(secrets ...[]byte) (*CookieStore, error) {
+	if len(secrets) == 0 {
+		return nil, errors.New("sessions: CookieStore needs at least one secret")
 	}
-	if password != "" {
-		if _, err := c.Do("AUTH", password); err != nil {
-			c.Close()
+	cs := &CookieStore{MaxAge: defaultCookieStoreMaxAge}
+	for _, secret := range secrets {
+		key := sha256.Sum256(secret)
+		block, err := aes.NewCipher(key[:])
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
 			return nil, err
 		}
+		cs.aeads = append(cs.aeads, aead)
 	}
-	return &RedisStore{conn: c}, nil
+	return cs, nil
 }
 
-func (rs *RedisStore) Close() error {
-	rs.conn.Close()
+func (cs *CookieStore) Close() error {
+	return nil
+}
+
+func (cs *CookieStore) now() time.Time {
+	if cs.Clock == nil {
+		return time.Now()
+	}
+	return cs.Clock.Now()
+}
+
+// Seal encrypts val for the cookie called name
+func (cs *CookieStore) Seal(name string, val []byte) (string, error) {
+	aead := cs.aeads[0]
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+8+len(val)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	plain := make([]byte, 8+len(val))
+	binary.BigEndian.PutUint64(plain, uint64(cs.now().Unix()))
+	copy(plain[8:], val)
+	return base64.RawURLEncoding.EncodeToString(aead.Seal(nonce, nonce, plain, []byte(name))), nil
+}
+
+// Open reverses Seal, anything that fails to authenticate, was sealed for
+// another cookie or is older than MaxAge is reported as a missing session
+func (cs *CookieStore) Open(name, value string) ([]byte, error) {
+	b, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return []byte(nil), nil
+	}
+	for _, aead := range cs.aeads {
+		if len(b) < aead.NonceSize() {
+			continue
+		}
+		plain, err := aead.Open(nil, b[:aead.NonceSize()], b[aead.NonceSize():], []byte(name))
+		if err != nil || len(plain) < 8 {
+			continue
+		}
+		sealed := time.Unix(int64(binary.BigEndian.Uint64(plain)), 0)
+		if 0 < cs.MaxAge && cs.MaxAge <= cs.now().Sub(sealed) {
+			return []byte(nil), nil
+		}
+		return plain[8:], nil
+	}
+	return []byte(nil), nil
+}
+
+// Get opens a value sealed for an empty cookie name
+func (cs *CookieStore) Get(key string) ([]byte, error) {
+	return cs.Open("", key)
+}
+
+func (cs *CookieStore) Set(key string, val []byte) error {
 	return nil
 }
 
+func (cs *CookieStore) Del(key string) error {
+	return nil
+}
+
+type RedisOptions struct {
+	Password    string
+	MaxIdle     int
+	MaxActive   int
+	IdleTimeout time.Duration
+	DialTimeout time.Duration
+	Wait        bool
+	// every borrowed connection is pinged unless this is positive, then only
+	// those idle for longer are, trading a failed request after a server
+	// restart for fewer round trips
+	PingAfterIdle time.Duration
+}
+
+var defaultRedisOptions = RedisOptions{
+	MaxIdle:     10,
+	IdleTimeout: 240 * time.Second,
+	DialTimeout: 5 * time.Second,
+}
+
+func NewRedisPool(network, address string, opt RedisOptions) *redis.Pool {
+	return &redis.Pool{
+		MaxIdle:     opt.MaxIdle,
+		MaxActive:   opt.MaxActive,
+		IdleTimeout: opt.IdleTimeout,
+		Wait:        opt.Wait,
+		Dial: func() (redis.Conn, error) {
+			c, err := redis.Dial(network, address, redis.DialConnectTimeout(opt.DialTimeout))
+			if err != nil {
+				return nil, err
+			}
+			if opt.Password != "" {
+				if _, err := c.Do("AUTH", opt.Password); err != nil {
+					c.Close()
+					return nil, err
+				}
+			}
+			return c, nil
+		},
+		TestOnBorrow: func(c redis.Conn, t time.Time) error {
+			if time.Since(t) < opt.PingAfterIdle {
+				return nil
+			}
+			_, err := c.Do("PING")
+			return err
+		},
+	}
+}
+
+type RedisStore struct {
+	pool   *redis.Pool
+	Prefix string
+}
+
+func NewRedisPoolStore(pool *redis.Pool) *RedisStore {
+	return &RedisStore{pool: pool}
+}
+
+func NewRedisStore(network, address, password string) (*RedisStore, error) {
+	opt := defaultRedisOptions
+	opt.Password = password
+	pool := NewRedisPool(network, address, opt)
+	c := pool.Get()
+	defer c.Close()
+	if _, err := c.Do("PING"); err != nil {
+		pool.Close()
+		return nil, err
+	}
+	return NewRedisPoolStore(pool), nil
+}
+
+func (rs *RedisStore) Close() error {
+	return rs.pool.Close()
+}
+
+func (rs *RedisStore) key(key string) string {
+	return rs.Prefix + key
+}
+
+var redisGlobEscaper = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`)
+
+// Keys returns the stored session keys under Prefix, with the prefix removed
+func (rs *RedisStore) Keys() ([]string, error) {
+	c := rs.pool.Get()
+	defer c.Close()
+	match := redisGlobEscaper.Replace(rs.Prefix) + "*"
+	var keys []string
+	cursor := 0
+	for {
+		values, err := redis.Values(c.Do("SCAN", cursor, "MATCH", match, "COUNT", 100))
+		if err != nil {
+			return nil, err
+		}
+		var found []string
+		if _, err := redis.Scan(values, &cursor, &found); err != nil {
+			return nil, err
+		}
+		for _, k := range found {
+			keys = append(keys, strings.TrimPrefix(k, rs.Prefix))
+		}
+		if cursor == 0 {
+			return keys, nil
+		}
+	}
+}
+
 func (rs *RedisStore) Get(key string) ([]byte, error) {
-	b, err := redis.Bytes(rs.conn.Do("GET", key))
+	c := rs.pool.Get()
+	defer c.Close()
+	b, err := redis.Bytes(c.Do("GET", rs.key(key)))
 	if err != nil {
 		if err == redis.ErrNil {
 			return []byte(nil), nil
@@ -88,11 +473,282 @@ func (rs *RedisStore) Get(key string) ([]byte, error) {
 }
 
 func (rs *RedisStore) Set(key string, val []byte) error {
-	_, err := rs.conn.Do("SET", key, val)
+	c := rs.pool.Get()
+	defer c.Close()
+	_, err := c.Do("SET", rs.key(key), val)
 	return err
 }
 
+func (rs *RedisStore) SetWithTTL(key string, val []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return rs.Set(key, val)
+	}
+	c := rs.pool.Get()
+	defer c.Close()
+	_, err := c.Do("SET", rs.key(key), val, "EX", ttlSeconds(ttl))
+	return err
+}
+
+// redisVersion identifies a value by its content, so no extra key is needed
+func redisVersion(b []byte) string {
+	if b == nil {
+		return ""
+	}
+	sum := sha1.Sum(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func (rs *RedisStore) GetVersion(key string) ([]byte, string, error) {
+	b, err := rs.Get(key)
+	if err != nil {
+		return nil, "", err
+	}
+	return b, redisVersion(b), nil
+}
+
+func (rs *RedisStore) CompareAndSet(key string, val []byte, version string, ttl time.Duration) (bool, error) {
+	c := rs.pool.Get()
+	defer c.Close()
+	k := rs.key(key)
+	if _, err := c.Do("WATCH", k); err != nil {
+		return false, err
+	}
+	cur, err := redis.Bytes(c.Do("GET", k))
+	if err != nil && err != redis.ErrNil {
+		return false, err
+	}
+	if redisVersion(cur) != version {
+		_, err := c.Do("UNWATCH")
+		return false, err
+	}
+	c.Send("MULTI")
+	if 0 < ttl {
+		c.Send("SET", k, val, "EX", ttlSeconds(ttl))
+	} else {
+		c.Send("SET", k, val)
+	}
+	reply, err := c.Do("EXEC")
+	if err != nil {
+		return false, err
+	}
+	// EXEC answers nil when the watched key changed
+	return reply != nil, nil
+}
+
 func (rs *RedisStore) Del(key string) error {
-	_, err := rs.conn.Do("DEL", key)
+	c := rs.pool.Get()
+	defer c.Close()
+	_, err := c.Do("DEL", rs.key(key))
+	return err
+}
+
+// FieldStore keeps every session value under a field of its own, so a save
+// only writes the fields a request changed. Each field holds the value alone,
+// encoded with the Sessions Codec.
+type FieldStore interface {
+	Store
+	// GetFields returns nil when key is absent and an empty map for an empty session
+	GetFields(key string) (map[string][]byte, error)
+	// SetFields writes set and removes del in one go, a positive ttl renews
+	// the expiry. Unless create is true a key that does not exist is left
+	// alone and false is returned, so a session deleted meanwhile stays gone.
+	SetFields(key string, set map[string][]byte, del []string, ttl time.Duration, create bool) (bool, error)
+}
+
+var errRedisHashBusy = errors.New("sessions: redis hash kept changing while writing fields")
+
+// redisHashMarker keeps the hash of an empty session in existence
+const redisHashMarker = "_sessions:hash"
+
+// redisHashRetries bounds the attempts of SetFields when other writers keep
+// touching the hash
+const redisHashRetries = 3
+
+// RedisHashStore keeps a session as a redis hash with a field per value.
+// Get and Set serve plain Store users by converting the whole session, Codec
+// has to match the one Sessions uses and defaults to GobCodec likewise.
+type RedisHashStore struct {
+	pool   *redis.Pool
+	Prefix string
+	Codec  Codec
+}
+
+func NewRedisPoolHashStore(pool *redis.Pool) *RedisHashStore {
+	return &RedisHashStore{pool: pool}
+}
+
+func NewRedisHashStore(network, address, password string) (*RedisHashStore, error) {
+	opt := defaultRedisOptions
+	opt.Password = password
+	pool := NewRedisPool(network, address, opt)
+	c := pool.Get()
+	defer c.Close()
+	if _, err := c.Do("PING"); err != nil {
+		pool.Close()
+		return nil, err
+	}
+	return NewRedisPoolHashStore(pool), nil
+}
+
+func (rs *RedisHashStore) Close() error {
+	return rs.pool.Close()
+}
+
+func (rs *RedisHashStore) key(key string) string {
+	return rs.Prefix + key
+}
+
+func (rs *RedisHashStore) codec() Codec {
+	if rs.Codec == nil {
+		return GobCodec{}
+	}
+	return rs.Codec
+}
+
+// Get reads every field and encodes them as one session
+func (rs *RedisHashStore) Get(key string) ([]byte, error) {
+	fields, err := rs.GetFields(key)
+	if err != nil || fields == nil {
+		return []byte(nil), err
+	}
+	values := make(sessionValues, len(fields))
+	for f, b := range fields {
+		v, err := unmarshalValue(rs.codec(), b)
+		if err != nil {
+			return nil, err
+		}
+		values[f] = v
+	}
+	return rs.codec().Marshal(values)
+}
+
+func (rs *RedisHashStore) Set(key string, val []byte) error {
+	return rs.SetWithTTL(key, val, 0)
+}
+
+// SetWithTTL decodes val as one session and replaces the hash with its fields
+func (rs *RedisHashStore) SetWithTTL(key string, val []byte, ttl time.Duration) error {
+	var values sessionValues
+	if err := rs.codec().Unmarshal(val, &values); err != nil {
+		return err
+	}
+	set := make(map[string][]byte, len(values))
+	for f, v := range values {
+		b, err := marshalValue(rs.codec(), v)
+		if err != nil {
+			return err
+		}
+		set[f] = b
+	}
+	c := rs.pool.Get()
+	defer c.Close()
+	k := rs.key(key)
+	c.Send("MULTI")
+	c.Send("DEL", k)
+	rs.sendFields(c, k, set, ttl)
+	_, err := c.Do("EXEC")
+	return err
+}
+
+func (rs *RedisHashStore) GetFields(key string) (map[string][]byte, error) {
+	c := rs.pool.Get()
+	defer c.Close()
+	values, err := redis.Values(c.Do("HGETALL", rs.key(key)))
+	if err != nil {
+		return nil, err
+	}
+	if len(values) == 0 {
+		return nil, nil
+	}
+	fields := make(map[string][]byte, len(values)/2)
+	for i := 0; i+1 < len(values); i += 2 {
+		k, err := redis.String(values[i], nil)
+		if err != nil {
+			return nil, err
+		}
+		if k == redisHashMarker {
+			continue
+		}
+		v, err := redis.Bytes(values[i+1], nil)
+		if err != nil {
+			return nil, err
+		}
+		fields[k] = v
+	}
+	return fields, nil
+}
+
+// GetField reads a single field, nil when it is absent
+func (rs *RedisHashStore) GetField(key, field string) ([]byte, error) {
+	c := rs.pool.Get()
+	defer c.Close()
+	b, err := redis.Bytes(c.Do("HGET", rs.key(key), field))
+	if err != nil {
+		if err == redis.ErrNil {
+			return []byte(nil), nil
+		}
+		return b, err
+	}
+	return b, nil
+}
+
+func (rs *RedisHashStore) HasField(key, field string) (bool, error) {
+	c := rs.pool.Get()
+	defer c.Close()
+	return redis.Bool(c.Do("HEXISTS", rs.key(key), field))
+}
+
+func (rs *RedisHashStore) SetFields(key string, set map[string][]byte, del []string, ttl time.Duration, create bool) (bool, error) {
+	c := rs.pool.Get()
+	defer c.Close()
+	k := rs.key(key)
+	for i := 0; ; i++ {
+		if !create {
+			if _, err := c.Do("WATCH", k); err != nil {
+				return false, err
+			}
+			ok, err := redis.Bool(c.Do("EXISTS", k))
+			if err != nil {
+				return false, err
+			}
+			if !ok {
+				_, err := c.Do("UNWATCH")
+				return false, err
+			}
+		}
+		c.Send("MULTI")
+		if 0 < len(del) {
+			c.Send("HDEL", redis.Args{}.Add(k).AddFlat(del)...)
+		}
+		rs.sendFields(c, k, set, ttl)
+		reply, err := c.Do("EXEC")
+		if err != nil {
+			return false, err
+		}
+		// EXEC answers nil when the watched key changed, it may be gone now
+		if reply != nil {
+			return true, nil
+		}
+		if redisHashRetries <= i {
+			return false, errRedisHashBusy
+		}
+	}
+}
+
+func (rs *RedisHashStore) sendFields(c redis.Conn, k string, set map[string][]byte, ttl time.Duration) {
+	args := redis.Args{}.Add(k, redisHashMarker, 1)
+	for f, v := range set {
+		args = args.Add(f, v)
+	}
+	c.Send("HMSET", args...)
+	if 0 < ttl {
+		c.Send("EXPIRE", k, ttlSeconds(ttl))
+	}
+}
+
+func (rs *RedisHashStore) Del(key string) error {
+	c := rs.pool.Get()
+	defer c.Close()
+	_, err := c.Do("DEL", rs.key(key))
 	return err
 }
@@ -1,8 +1,13 @@
 package sessions_test
 
 import (
+	"encoding/base64"
+	"fmt"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/garyburd/redigo/redis"
 	"github.com/mix3/fever-sessions"
 	"github.com/soh335/go-test-redisserver"
 	"github.com/stretchr/testify/assert"
@@ -22,6 +27,190 @@ func TestMemoryStore(t *testing.T) {
 	}
 }
 
+func TestMemoryStoreTTL(t *testing.T) {
+	clock := newFakeClock()
+	ms := sessions.NewMemoryStore(sessions.WithClock(clock))
+	ms.SetWithTTL("hoge", []byte("fuga"), time.Hour)
+	{
+		v, _ := ms.Get("hoge")
+		assert.Equal(t, []byte("fuga"), v)
+	}
+	ms.SetWithTTL("hoge", []byte("fuga"), time.Minute)
+	clock.Add(59 * time.Second)
+	{
+		v, _ := ms.Get("hoge")
+		assert.Equal(t, []byte("fuga"), v)
+	}
+	clock.Add(time.Second)
+	{
+		v, _ := ms.Get("hoge")
+		assert.Equal(t, []byte(nil), v)
+	}
+}
+
+func TestMemoryStoreCompareAndSet(t *testing.T) {
+	clock := newFakeClock()
+	ms := sessions.NewMemoryStore(sessions.WithClock(clock))
+	{
+		ok, err := ms.CompareAndSet("hoge", []byte("fuga"), "", 0)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	}
+	v, version, _ := ms.GetVersion("hoge")
+	assert.Equal(t, []byte("fuga"), v)
+	assert.NotEqual(t, "", version)
+	{
+		ok, _ := ms.CompareAndSet("hoge", []byte("piyo"), "", 0)
+		assert.False(t, ok)
+	}
+	ms.Set("hoge", []byte("foo"))
+	{
+		ok, _ := ms.CompareAndSet("hoge", []byte("piyo"), version, 0)
+		assert.False(t, ok)
+		v, _ := ms.Get("hoge")
+		assert.Equal(t, []byte("foo"), v)
+	}
+	_, version, _ = ms.GetVersion("hoge")
+	{
+		ok, _ := ms.CompareAndSet("hoge", []byte("piyo"), version, time.Minute)
+		assert.True(t, ok)
+	}
+	clock.Add(time.Minute)
+	{
+		v, version, _ := ms.GetVersion("hoge")
+		assert.Equal(t, []byte(nil), v)
+		assert.Equal(t, "", version)
+	}
+}
+
+type fakeClock struct {
+	sync.Mutex
+	now  time.Time
+	tick chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{
+		now:  time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC),
+		tick: make(chan time.Time),
+	}
+}
+
+func (fc *fakeClock) Now() time.Time {
+	fc.Lock()
+	defer fc.Unlock()
+	return fc.now
+}
+
+func (fc *fakeClock) After(d time.Duration) <-chan time.Time {
+	return fc.tick
+}
+
+func (fc *fakeClock) Add(d time.Duration) {
+	fc.Lock()
+	defer fc.Unlock()
+	fc.now = fc.now.Add(d)
+}
+
+// Advance moves the clock forward and blocks until the janitor receives the tick
+func (fc *fakeClock) Advance(d time.Duration) {
+	fc.Lock()
+	fc.now = fc.now.Add(d)
+	now := fc.now
+	fc.Unlock()
+	fc.tick <- now
+}
+
+// Sweep moves the clock forward and returns once the janitor has finished
+// the sweep that started, as the second tick is only received after it
+func (fc *fakeClock) Sweep(d time.Duration) {
+	fc.Advance(d)
+	fc.Advance(0)
+}
+
+func TestMemoryStoreGC(t *testing.T) {
+	clock := newFakeClock()
+	ms := sessions.NewMemoryStore(sessions.WithGCInterval(time.Minute), sessions.WithClock(clock))
+	ms.SetWithTTL("hoge", []byte("hoge"), time.Minute)
+	ms.SetWithTTL("fuga", []byte("fuga"), time.Hour)
+	ms.Set("piyo", []byte("piyo"))
+	assert.Equal(t, 3, ms.Len())
+
+	clock.Sweep(2 * time.Minute)
+	assert.Equal(t, 2, ms.Len())
+	{
+		v, _ := ms.Get("hoge")
+		assert.Equal(t, []byte(nil), v)
+	}
+	{
+		v, _ := ms.Get("fuga")
+		assert.Equal(t, []byte("fuga"), v)
+	}
+
+	clock.Sweep(2 * time.Hour)
+	assert.Equal(t, 1, ms.Len())
+
+	assert.NoError(t, ms.Close())
+	assert.NoError(t, ms.Close())
+}
+
+func TestCookieStore(t *testing.T) {
+	_, err := sessions.NewCookieStore()
+	assert.Error(t, err)
+
+	old, _ := sessions.NewCookieStore([]byte("old-secret"))
+	cs, _ := sessions.NewCookieStore([]byte("new-secret"), []byte("old-secret"))
+	sealed, err := cs.Seal("hoge", []byte("fuga"))
+	assert.NoError(t, err)
+	{
+		v, _ := cs.Open("hoge", sealed)
+		assert.Equal(t, []byte("fuga"), v)
+		v, _ = old.Open("hoge", sealed)
+		assert.Equal(t, []byte(nil), v)
+		// sealed for another cookie
+		v, _ = cs.Open("piyo", sealed)
+		assert.Equal(t, []byte(nil), v)
+	}
+	{
+		sealed, _ := old.Seal("hoge", []byte("fuga"))
+		v, _ := cs.Open("hoge", sealed)
+		assert.Equal(t, []byte("fuga"), v)
+	}
+	{
+		b, _ := base64.RawURLEncoding.DecodeString(sealed)
+		b[len(b)-1] ^= 1
+		v, err := cs.Open("hoge", base64.RawURLEncoding.EncodeToString(b))
+		assert.NoError(t, err)
+		assert.Equal(t, []byte(nil), v)
+		v, err = cs.Open("hoge", "not base64!")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte(nil), v)
+	}
+}
+
+func TestCookieStoreMaxAge(t *testing.T) {
+	clock := newFakeClock()
+	cs, _ := sessions.NewCookieStore([]byte("secret"))
+	cs.Clock = clock
+	cs.MaxAge = time.Hour
+	sealed, _ := cs.Seal("hoge", []byte("fuga"))
+	clock.Add(59 * time.Minute)
+	{
+		v, _ := cs.Open("hoge", sealed)
+		assert.Equal(t, []byte("fuga"), v)
+	}
+	clock.Add(time.Minute)
+	{
+		v, _ := cs.Open("hoge", sealed)
+		assert.Equal(t, []byte(nil), v)
+	}
+	cs.MaxAge = 0
+	{
+		v, _ := cs.Open("hoge", sealed)
+		assert.Equal(t, []byte("fuga"), v)
+	}
+}
+
 func TestRedisStore(t *testing.T) {
 	s, err := redistest.NewServer(true, nil)
 	if err != nil {
@@ -43,3 +232,285 @@ func TestRedisStore(t *testing.T) {
 		assert.Equal(t, []byte(nil), v)
 	}
 }
+
+func TestRedisStoreTTL(t *testing.T) {
+	s, err := redistest.NewServer(true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	rs, err := sessions.NewRedisStore("unix", s.Config["unixsocket"], "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := redis.Dial("unix", s.Config["unixsocket"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	rs.Set("hoge", []byte("fuga"))
+	{
+		ttl, _ := redis.Int(conn.Do("TTL", "hoge"))
+		assert.Equal(t, -1, ttl)
+	}
+	rs.SetWithTTL("hoge", []byte("fuga"), 1500*time.Millisecond)
+	{
+		v, _ := rs.Get("hoge")
+		assert.Equal(t, []byte("fuga"), v)
+		ttl, _ := redis.Int(conn.Do("TTL", "hoge"))
+		assert.Equal(t, 2, ttl)
+	}
+}
+
+func TestRedisStoreCompareAndSet(t *testing.T) {
+	s, err := redistest.NewServer(true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	rs, err := sessions.NewRedisStore("unix", s.Config["unixsocket"], "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	{
+		ok, err := rs.CompareAndSet("hoge", []byte("fuga"), "", 0)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	}
+	v, version, _ := rs.GetVersion("hoge")
+	assert.Equal(t, []byte("fuga"), v)
+	{
+		ok, _ := rs.CompareAndSet("hoge", []byte("piyo"), "", 0)
+		assert.False(t, ok)
+	}
+	rs.Set("hoge", []byte("foo"))
+	{
+		ok, _ := rs.CompareAndSet("hoge", []byte("piyo"), version, 0)
+		assert.False(t, ok)
+		v, _ := rs.Get("hoge")
+		assert.Equal(t, []byte("foo"), v)
+	}
+	_, version, _ = rs.GetVersion("hoge")
+	{
+		ok, err := rs.CompareAndSet("hoge", []byte("piyo"), version, time.Hour)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		v, _ := rs.Get("hoge")
+		assert.Equal(t, []byte("piyo"), v)
+	}
+}
+
+func TestRedisPoolStore(t *testing.T) {
+	s, err := redistest.NewServer(true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	rs := sessions.NewRedisPoolStore(sessions.NewRedisPool("unix", s.Config["unixsocket"], sessions.RedisOptions{
+		MaxIdle:     4,
+		MaxActive:   8,
+		Wait:        true,
+		DialTimeout: time.Second,
+	}))
+	defer rs.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				key := fmt.Sprintf("key-%d", i)
+				val := []byte(fmt.Sprintf("val-%d-%d", i, j))
+				if err := rs.Set(key, val); err != nil {
+					t.Error(err)
+					return
+				}
+				v, err := rs.Get(key)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				assert.Equal(t, val, v)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestRedisPoolStoreReconnect(t *testing.T) {
+	s, err := redistest.NewServer(true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	conn, err := redis.Dial("unix", s.Config["unixsocket"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// drop every pooled connection as a server restart would
+	restart := func() {
+		if _, err := conn.Do("CLIENT", "KILL", "TYPE", "normal"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// pinging every borrow hides the restart
+	rs := sessions.NewRedisPoolStore(sessions.NewRedisPool("unix", s.Config["unixsocket"], sessions.RedisOptions{
+		MaxIdle: 1,
+	}))
+	defer rs.Close()
+	assert.NoError(t, rs.Set("hoge", []byte("fuga")))
+	restart()
+	{
+		v, err := rs.Get("hoge")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("fuga"), v)
+	}
+
+	// recently used connections are trusted, a dead one fails once and is dropped
+	rs2 := sessions.NewRedisPoolStore(sessions.NewRedisPool("unix", s.Config["unixsocket"], sessions.RedisOptions{
+		MaxIdle:       1,
+		PingAfterIdle: time.Minute,
+	}))
+	defer rs2.Close()
+	assert.NoError(t, rs2.Set("hoge", []byte("fuga")))
+	restart()
+	{
+		_, err := rs2.Get("hoge")
+		assert.Error(t, err)
+		v, err := rs2.Get("hoge")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("fuga"), v)
+	}
+}
+
+func TestRedisStorePrefix(t *testing.T) {
+	s, err := redistest.NewServer(true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	rs, err := sessions.NewRedisStore("unix", s.Config["unixsocket"], "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rs.Close()
+	rs.Prefix = "myapp:sess:"
+	conn, err := redis.Dial("unix", s.Config["unixsocket"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Do("SET", "hoge", "other")
+
+	rs.Set("hoge", []byte("fuga"))
+	{
+		v, _ := redis.Bytes(conn.Do("GET", "myapp:sess:hoge"))
+		assert.Equal(t, []byte("fuga"), v)
+		v, _ = rs.Get("hoge")
+		assert.Equal(t, []byte("fuga"), v)
+	}
+	{
+		keys, err := rs.Keys()
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"hoge"}, keys)
+	}
+	rs.Del("hoge")
+	{
+		v, _ := redis.Bytes(conn.Do("GET", "hoge"))
+		assert.Equal(t, []byte("other"), v)
+		keys, err := rs.Keys()
+		assert.NoError(t, err)
+		assert.Len(t, keys, 0)
+	}
+}
+
+func TestRedisHashStore(t *testing.T) {
+	s, err := redistest.NewServer(true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	rs, err := sessions.NewRedisHashStore("unix", s.Config["unixsocket"], "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rs.Close()
+	rs.Prefix = "myapp:sess:"
+	conn, err := redis.Dial("unix", s.Config["unixsocket"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	{
+		fields, err := rs.GetFields("hoge")
+		assert.NoError(t, err)
+		assert.Nil(t, fields)
+	}
+	{
+		// only creates when asked to
+		ok, err := rs.SetFields("hoge", map[string][]byte{"foo": []byte("1")}, nil, 0, false)
+		assert.NoError(t, err)
+		assert.False(t, ok)
+		fields, _ := rs.GetFields("hoge")
+		assert.Nil(t, fields)
+		ok, err = rs.SetFields("hoge", nil, nil, 0, true)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	}
+	{
+		fields, err := rs.GetFields("hoge")
+		assert.NoError(t, err)
+		assert.Equal(t, map[string][]byte{}, fields)
+	}
+	rs.SetFields("hoge", map[string][]byte{"foo": []byte("1"), "bar": []byte("2")}, nil, 0, false)
+	rs.SetFields("hoge", map[string][]byte{"baz": []byte("3")}, []string{"foo"}, 1500*time.Millisecond, false)
+	{
+		fields, _ := rs.GetFields("hoge")
+		assert.Equal(t, map[string][]byte{"bar": []byte("2"), "baz": []byte("3")}, fields)
+		v, _ := rs.GetField("hoge", "bar")
+		assert.Equal(t, []byte("2"), v)
+		v, _ = rs.GetField("hoge", "foo")
+		assert.Equal(t, []byte(nil), v)
+		ok, _ := rs.HasField("hoge", "baz")
+		assert.True(t, ok)
+		ok, _ = rs.HasField("hoge", "foo")
+		assert.False(t, ok)
+		v, _ = redis.Bytes(conn.Do("HGET", "myapp:sess:hoge", "baz"))
+		assert.Equal(t, []byte("3"), v)
+		ttl, _ := redis.Int(conn.Do("TTL", "myapp:sess:hoge"))
+		assert.Equal(t, 2, ttl)
+	}
+	{
+		// plain Store users see the whole session encoded with Codec
+		blob, _ := sessions.GobCodec{}.Marshal(map[string]interface{}{"user": "foo", "n": 1})
+		assert.NoError(t, rs.Set("piyo", blob))
+		b, err := rs.Get("piyo")
+		assert.NoError(t, err)
+		var values map[string]interface{}
+		assert.NoError(t, sessions.GobCodec{}.Unmarshal(b, &values))
+		assert.Equal(t, map[string]interface{}{"user": "foo", "n": 1}, values)
+	}
+	{
+		rs.Codec = sessions.JSONCodec{}
+		assert.NoError(t, rs.Set("piyo", []byte(`{"user":"foo","n":1}`)))
+		v, _ := redis.String(conn.Do("HGET", "myapp:sess:piyo", "user"))
+		assert.Equal(t, `"foo"`, v)
+		b, err := rs.Get("piyo")
+		assert.NoError(t, err)
+		assert.JSONEq(t, `{"user":"foo","n":1}`, string(b))
+		assert.NoError(t, rs.Set("piyo", []byte(`{"n":2}`)))
+		b, _ = rs.Get("piyo")
+		assert.JSONEq(t, `{"n":2}`, string(b))
+		b, err = rs.Get("nothing")
+		assert.NoError(t, err)
+		assert.Nil(t, b)
+	}
+	rs.Del("hoge")
+	{
+		fields, _ := rs.GetFields("hoge")
+		assert.Nil(t, fields)
+	}
+}
@@ -0,0 +1,389 @@
+package sessions
+
+import (
+	"container/list"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Invalidator spreads writes between the nodes sharing a remote store, so
+// each can drop the copies it caches
+type Invalidator interface {
+	io.Closer
+	// Publish announces that key changed on this node
+	Publish(key string) error
+	// Subscribe calls evict for keys changed on other nodes, and purge when
+	// announcements may have been missed
+	Subscribe(evict func(key string), purge func()) error
+}
+
+var errTieredNotVersioned = errors.New("sessions: the remote store of TieredStore has no compare-and-set")
+
+type tieredEntry struct {
+	key string
+	val []byte
+	// version is empty when the copy was not read through GetVersion
+	version string
+	expires time.Time
+}
+
+// TieredStore caches a remote store in a bounded LRU. Writes go through to
+// the remote store, local copies live for ttl at most and misses are not
+// cached, so a session created on another node is seen right away.
+// Compare-and-set is passed through to a remote VersionedStore, with any
+// other remote Sessions saves the way it does without one. A FieldStore is
+// refused as caching it would turn its per-field writes into whole ones.
+type TieredStore struct {
+	sync.Mutex
+	remote      Store
+	size        int
+	ttl         time.Duration
+	clock       Clock
+	invalidator Invalidator
+	ll          *list.List
+	items       map[string]*list.Element
+	// gen changes on every write and eviction, a Get only caches what it
+	// read when nothing happened meanwhile
+	gen uint64
+	// OnPublishError receives announcements the invalidator failed to send,
+	// the write itself has succeeded. They are dropped when it is nil.
+	OnPublishError func(key string, err error)
+}
+
+func NewTieredStore(remote Store, size int, ttl time.Duration, opts ...StoreOption) (*TieredStore, error) {
+	if _, ok := remote.(FieldStore); ok {
+		return nil, fmt.Errorf("%w: TieredStore cannot cache a FieldStore", ErrInvalidConfig)
+	}
+	o := newStoreOptions(opts)
+	ts := &TieredStore{
+		remote:      remote,
+		size:        size,
+		ttl:         ttl,
+		clock:       o.clock,
+		invalidator: o.invalidator,
+		ll:          list.New(),
+		items:       make(map[string]*list.Element),
+	}
+	if ts.invalidator != nil {
+		err := ts.invalidator.Subscribe(ts.evict, ts.Purge)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ts, nil
+}
+
+// Close stops listening to the invalidator, the remote store is left to the
+// caller as it may share connections with it
+func (ts *TieredStore) Close() error {
+	if ts.invalidator != nil {
+		return ts.invalidator.Close()
+	}
+	return nil
+}
+
+func (ts *TieredStore) Len() int {
+	ts.Lock()
+	defer ts.Unlock()
+	return ts.ll.Len()
+}
+
+// Purge drops every local copy
+func (ts *TieredStore) Purge() {
+	ts.Lock()
+	defer ts.Unlock()
+	ts.gen++
+	ts.ll.Init()
+	ts.items = make(map[string]*list.Element)
+}
+
+func (ts *TieredStore) evict(key string) {
+	ts.Lock()
+	defer ts.Unlock()
+	ts.gen++
+	if e, ok := ts.items[key]; ok {
+		ts.ll.Remove(e)
+		delete(ts.items, key)
+	}
+}
+
+// cache keeps val for at most ttl, and no longer than the remote copy lives
+func (ts *TieredStore) cache(key string, val []byte, version string, ttl time.Duration) {
+	if ts.size <= 0 || ts.ttl <= 0 {
+		return
+	}
+	if ttl <= 0 || ts.ttl < ttl {
+		ttl = ts.ttl
+	}
+	entry := &tieredEntry{key: key, val: val, version: version, expires: ts.clock.Now().Add(ttl)}
+	if e, ok := ts.items[key]; ok {
+		e.Value = entry
+		ts.ll.MoveToFront(e)
+		return
+	}
+	ts.items[key] = ts.ll.PushFront(entry)
+	for ts.size < ts.ll.Len() {
+		e := ts.ll.Back()
+		ts.ll.Remove(e)
+		delete(ts.items, e.Value.(*tieredEntry).key)
+	}
+}
+
+// lookup returns the live local copy of key, with its generation for caching
+// what is read from the remote store otherwise
+func (ts *TieredStore) lookup(key string) (*tieredEntry, uint64) {
+	ts.Lock()
+	defer ts.Unlock()
+	if e, ok := ts.items[key]; ok {
+		entry := e.Value.(*tieredEntry)
+		if ts.clock.Now().Before(entry.expires) {
+			ts.ll.MoveToFront(e)
+			return entry, ts.gen
+		}
+		ts.ll.Remove(e)
+		delete(ts.items, key)
+	}
+	return nil, ts.gen
+}
+
+func (ts *TieredStore) Get(key string) ([]byte, error) {
+	entry, gen := ts.lookup(key)
+	if entry != nil {
+		return entry.val, nil
+	}
+	val, err := ts.remote.Get(key)
+	if err != nil || val == nil {
+		return val, err
+	}
+	ts.Lock()
+	if gen == ts.gen {
+		ts.cache(key, val, "", 0)
+	}
+	ts.Unlock()
+	return val, nil
+}
+
+func (ts *TieredStore) versioned() bool {
+	_, ok := ts.remote.(VersionedStore)
+	return ok
+}
+
+// GetVersion serves copies read through GetVersion locally and asks the
+// remote store otherwise
+func (ts *TieredStore) GetVersion(key string) ([]byte, string, error) {
+	vs, ok := ts.remote.(VersionedStore)
+	if !ok {
+		return nil, "", errTieredNotVersioned
+	}
+	entry, gen := ts.lookup(key)
+	if entry != nil && entry.version != "" {
+		return entry.val, entry.version, nil
+	}
+	val, version, err := vs.GetVersion(key)
+	if err != nil || val == nil {
+		return val, version, err
+	}
+	ts.Lock()
+	if gen == ts.gen {
+		ts.cache(key, val, version, 0)
+	}
+	ts.Unlock()
+	return val, version, nil
+}
+
+// CompareAndSet drops the local copy whatever the outcome, the new version is
+// only known to the remote store
+func (ts *TieredStore) CompareAndSet(key string, val []byte, version string, ttl time.Duration) (bool, error) {
+	vs, ok := ts.remote.(VersionedStore)
+	if !ok {
+		return false, errTieredNotVersioned
+	}
+	ok, err := vs.CompareAndSet(key, val, version, ttl)
+	ts.evict(key)
+	if ok {
+		ts.publish(key)
+	}
+	return ok, err
+}
+
+func (ts *TieredStore) Set(key string, val []byte) error {
+	return ts.SetWithTTL(key, val, 0)
+}
+
+func (ts *TieredStore) SetWithTTL(key string, val []byte, ttl time.Duration) error {
+	var err error
+	if tts, ok := ts.remote.(TTLStore); ok && 0 < ttl {
+		err = tts.SetWithTTL(key, val, ttl)
+	} else {
+		err = ts.remote.Set(key, val)
+	}
+	ts.Lock()
+	ts.gen++
+	if err == nil {
+		ts.cache(key, val, "", ttl)
+	} else if e, ok := ts.items[key]; ok {
+		// the remote value is unknown now
+		ts.ll.Remove(e)
+		delete(ts.items, key)
+	}
+	ts.Unlock()
+	if err != nil {
+		return err
+	}
+	ts.publish(key)
+	return nil
+}
+
+func (ts *TieredStore) Del(key string) error {
+	err := ts.remote.Del(key)
+	// also drops a copy a concurrent Get cached before the remote delete
+	ts.evict(key)
+	if err != nil {
+		return err
+	}
+	ts.publish(key)
+	return nil
+}
+
+// publish announces a write that already succeeded, so a failure is only
+// reported and not returned
+func (ts *TieredStore) publish(key string) {
+	if ts.invalidator == nil {
+		return
+	}
+	err := ts.invalidator.Publish(key)
+	if err != nil && ts.OnPublishError != nil {
+		ts.OnPublishError(key, err)
+	}
+}
+
+var errRedisInvalidatorClosed = errors.New("sessions: RedisInvalidator is closed")
+
+// redisResubscribeDelay caps the wait between attempts to resubscribe
+const redisResubscribeDelay = 5 * time.Second
+
+// RedisInvalidator announces changed keys on a redis pub/sub channel. Every
+// node ignores its own announcements and purges its cache after it had to
+// resubscribe.
+type RedisInvalidator struct {
+	pool    *redis.Pool
+	channel string
+	id      string
+
+	mu     sync.Mutex
+	conn   redis.Conn
+	closed bool
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+func NewRedisInvalidator(pool *redis.Pool, channel string) (*RedisInvalidator, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return &RedisInvalidator{
+		pool:    pool,
+		channel: channel,
+		id:      hex.EncodeToString(b),
+		stop:    make(chan struct{}),
+	}, nil
+}
+
+func (ri *RedisInvalidator) Publish(key string) error {
+	c := ri.pool.Get()
+	defer c.Close()
+	_, err := c.Do("PUBLISH", ri.channel, ri.id+" "+key)
+	return err
+}
+
+// subscribe uses a connection of its own, a pooled one would be unsubscribed
+// on Close while the receiver is still reading it
+func (ri *RedisInvalidator) subscribe() (redis.PubSubConn, error) {
+	c, err := ri.pool.Dial()
+	if err != nil {
+		return redis.PubSubConn{}, err
+	}
+	psc := redis.PubSubConn{Conn: c}
+	if err := psc.Subscribe(ri.channel); err != nil {
+		c.Close()
+		return redis.PubSubConn{}, err
+	}
+	ri.mu.Lock()
+	defer ri.mu.Unlock()
+	if ri.closed {
+		c.Close()
+		return redis.PubSubConn{}, errRedisInvalidatorClosed
+	}
+	ri.conn = c
+	return psc, nil
+}
+
+func (ri *RedisInvalidator) Subscribe(evict func(key string), purge func()) error {
+	psc, err := ri.subscribe()
+	if err != nil {
+		return err
+	}
+	ri.done = make(chan struct{})
+	go ri.receive(psc, evict, purge)
+	return nil
+}
+
+func (ri *RedisInvalidator) receive(psc redis.PubSubConn, evict func(key string), purge func()) {
+	defer close(ri.done)
+	for {
+		switch v := psc.Receive().(type) {
+		case redis.Message:
+			id, key, ok := strings.Cut(string(v.Data), " ")
+			if ok && id != ri.id {
+				evict(key)
+			}
+		case error:
+			psc.Close()
+			delay := 50 * time.Millisecond
+			for {
+				select {
+				case <-ri.stop:
+					return
+				case <-time.After(delay):
+				}
+				var err error
+				psc, err = ri.subscribe()
+				if err == nil {
+					break
+				}
+				if delay *= 2; redisResubscribeDelay < delay {
+					delay = redisResubscribeDelay
+				}
+			}
+			// announcements sent while disconnected are lost
+			purge()
+		}
+	}
+}
+
+func (ri *RedisInvalidator) Close() error {
+	ri.mu.Lock()
+	if ri.closed {
+		ri.mu.Unlock()
+		return nil
+	}
+	ri.closed = true
+	close(ri.stop)
+	if ri.conn != nil {
+		ri.conn.Close()
+	}
+	ri.mu.Unlock()
+	if ri.done != nil {
+		<-ri.done
+	}
+	return nil
+}
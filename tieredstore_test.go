@@ -0,0 +1,269 @@
+package sessions_test
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/mix3/fever-sessions"
+	"github.com/mix3/fever/mux"
+	"github.com/soh335/go-test-redisserver"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTieredStore(t *testing.T) {
+	fc := newFakeClock()
+	remote := &countingStore{MemoryStore: sessions.NewMemoryStore(sessions.WithClock(fc))}
+	defer remote.Close()
+	ts, err := sessions.NewTieredStore(remote, 2, time.Minute, sessions.WithClock(fc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+	ts.Set("hoge", []byte("fuga"))
+	for i := 0; i < 3; i++ {
+		v, _ := ts.Get("hoge")
+		assert.Equal(t, []byte("fuga"), v)
+	}
+	assert.Equal(t, 1, remote.sets)
+	assert.Equal(t, 0, remote.gets)
+
+	// the local copy expires, the remote one is read again
+	remote.MemoryStore.Set("hoge", []byte("piyo"))
+	fc.Add(time.Minute)
+	for i := 0; i < 3; i++ {
+		v, _ := ts.Get("hoge")
+		assert.Equal(t, []byte("piyo"), v)
+	}
+	assert.Equal(t, 1, remote.gets)
+
+	ts.Del("hoge")
+	for i := 0; i < 2; i++ {
+		v, err := ts.Get("hoge")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte(nil), v)
+	}
+	// misses are not cached
+	assert.Equal(t, 3, remote.gets)
+
+	ts.Set("foo", []byte("1"))
+	ts.Set("bar", []byte("2"))
+	ts.Get("foo")
+	ts.Set("baz", []byte("3"))
+	assert.Equal(t, 2, ts.Len())
+	{
+		// bar was the least recently used
+		v, _ := ts.Get("bar")
+		assert.Equal(t, []byte("2"), v)
+		assert.Equal(t, 4, remote.gets)
+		ts.Get("baz")
+		assert.Equal(t, 4, remote.gets)
+	}
+
+	// a short remote ttl bounds the local one
+	ts.SetWithTTL("qux", []byte("4"), time.Second)
+	fc.Add(time.Second)
+	{
+		v, _ := ts.Get("qux")
+		assert.Equal(t, []byte(nil), v)
+	}
+}
+
+func TestTieredStoreInvalidation(t *testing.T) {
+	s, err := redistest.NewServer(true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	node := func() (*sessions.TieredStore, *sessions.RedisStore) {
+		pool := sessions.NewRedisPool("unix", s.Config["unixsocket"], sessions.RedisOptions{MaxIdle: 2})
+		inv, err := sessions.NewRedisInvalidator(pool, "sessions:invalidate")
+		if err != nil {
+			t.Fatal(err)
+		}
+		rs := sessions.NewRedisPoolStore(pool)
+		ts, err := sessions.NewTieredStore(rs, 100, time.Hour, sessions.WithInvalidator(inv))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ts, rs
+	}
+	a, ra := node()
+	b, rb := node()
+	defer ra.Close()
+	defer rb.Close()
+	defer a.Close()
+	defer b.Close()
+
+	a.Set("hoge", []byte("fuga"))
+	// the announcement of the write may still evict what b cached
+	assert.Eventually(t, func() bool {
+		v, _ := b.Get("hoge")
+		return string(v) == "fuga" && b.Len() == 1
+	}, time.Second, 10*time.Millisecond)
+	a.Set("hoge", []byte("piyo"))
+	assert.Eventually(t, func() bool {
+		v, _ := b.Get("hoge")
+		return string(v) == "piyo"
+	}, time.Second, 10*time.Millisecond)
+	{
+		// a keeps its own fresh copy
+		assert.Equal(t, 1, a.Len())
+	}
+	a.Del("hoge")
+	assert.Eventually(t, func() bool {
+		return b.Len() == 0
+	}, time.Second, 10*time.Millisecond)
+
+	b.Set("foo", []byte("bar"))
+	assert.Equal(t, 1, b.Len())
+	conn, err := redis.Dial("unix", s.Config["unixsocket"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// drop the subscriptions as a server restart would, missed announcements
+	// leave nothing to trust in the local cache
+	if _, err := conn.Do("CLIENT", "KILL", "TYPE", "normal"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Eventually(t, func() bool {
+		return b.Len() == 0
+	}, time.Second, 10*time.Millisecond)
+	{
+		v, _ := b.Get("foo")
+		assert.Equal(t, []byte("bar"), v)
+	}
+	a.Set("foo", []byte("baz"))
+	assert.Eventually(t, func() bool {
+		v, _ := b.Get("foo")
+		return string(v) == "baz"
+	}, time.Second, 10*time.Millisecond)
+
+	// closing the cache leaves the remote store and its pool alone
+	assert.NoError(t, a.Close())
+	{
+		v, err := ra.Get("foo")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("baz"), v)
+	}
+}
+
+func TestTieredStoreCompareAndSet(t *testing.T) {
+	remote := sessions.NewMemoryStore()
+	defer remote.Close()
+	ts, err := sessions.NewTieredStore(remote, 10, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+	var _ sessions.VersionedStore = ts
+	{
+		ok, err := ts.CompareAndSet("hoge", []byte("fuga"), "", 0)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+	}
+	v, version, _ := ts.GetVersion("hoge")
+	assert.Equal(t, []byte("fuga"), v)
+	assert.NotEqual(t, "", version)
+	// written behind the cache's back, the cached version is stale
+	remote.Set("hoge", []byte("piyo"))
+	{
+		_, cached, _ := ts.GetVersion("hoge")
+		assert.Equal(t, version, cached)
+		ok, err := ts.CompareAndSet("hoge", []byte("foo"), cached, 0)
+		assert.NoError(t, err)
+		assert.False(t, ok)
+	}
+	v, version, _ = ts.GetVersion("hoge")
+	assert.Equal(t, []byte("piyo"), v)
+	{
+		ok, _ := ts.CompareAndSet("hoge", []byte("foo"), version, 0)
+		assert.True(t, ok)
+		v, _ := remote.Get("hoge")
+		assert.Equal(t, []byte("foo"), v)
+	}
+
+	// without compare-and-set on the remote Sessions saves as it would
+	// without the cache
+	plain, err := sessions.NewTieredStore(&unversionedStore{remote}, 10, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	ss := sessions.New(plain, "myapp_session")
+	ss.CheckConflicts = true
+	ss.ErrorHandler = func(c context.Context, w http.ResponseWriter, r *http.Request, err error) {
+		t.Error(err)
+	}
+	m := mux.New()
+	m.Use(ss.Middleware)
+	m.Get("/").ThenFunc(func(c context.Context, w http.ResponseWriter, r *http.Request) {
+		s := sessions.Session(c)
+		v := 1
+		if s.Exists("counter") {
+			v = s.Get("counter").(int) + 1
+		}
+		s.Set("counter", v)
+		fmt.Fprintf(w, "counter=>%d", v)
+	})
+	srv := httptest.NewServer(m)
+	defer srv.Close()
+	c := newClient(t)
+	for i := 1; i <= 2; i++ {
+		_, body, _ := c.Get(t, srv.URL, "myapp_session")
+		assert.Equal(t, fmt.Sprintf("counter=>%d", i), body)
+	}
+
+	pool := sessions.NewRedisPool("unix", "/nonexistent", sessions.RedisOptions{})
+	defer pool.Close()
+	_, err = sessions.NewTieredStore(sessions.NewRedisPoolHashStore(pool), 10, time.Hour)
+	assert.True(t, errors.Is(err, sessions.ErrInvalidConfig))
+}
+
+// unversionedStore hides the compare-and-set of the store it wraps
+type unversionedStore struct {
+	sessions.Store
+}
+
+type failingInvalidator struct{}
+
+func (failingInvalidator) Close() error {
+	return nil
+}
+
+func (failingInvalidator) Publish(key string) error {
+	return errors.New("publish failed")
+}
+
+func (failingInvalidator) Subscribe(evict func(key string), purge func()) error {
+	return nil
+}
+
+func TestTieredStorePublishError(t *testing.T) {
+	remote := sessions.NewMemoryStore()
+	defer remote.Close()
+	ts, err := sessions.NewTieredStore(remote, 10, time.Hour, sessions.WithInvalidator(failingInvalidator{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+	var failed []string
+	ts.OnPublishError = func(key string, err error) {
+		failed = append(failed, key)
+	}
+	// the writes went through, only the announcements were lost
+	assert.NoError(t, ts.Set("hoge", []byte("fuga")))
+	{
+		v, _ := remote.Get("hoge")
+		assert.Equal(t, []byte("fuga"), v)
+	}
+	assert.NoError(t, ts.Del("hoge"))
+	assert.Equal(t, []string{"hoge", "hoge"}, failed)
+}
@@ -0,0 +1,86 @@
+package sessions
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Transport carries the session id between client and server. Emit gets the
+// cookie settings of the session, a negative MaxAge asks to forget the value.
+type Transport interface {
+	Extract(r *http.Request) (string, bool)
+	Emit(w http.ResponseWriter, value string, o CookieOptions)
+}
+
+type CookieTransport struct {
+	Name string
+}
+
+func (ct CookieTransport) Extract(r *http.Request) (string, bool) {
+	cookie, _ := r.Cookie(ct.Name)
+	if cookie == nil {
+		return "", false
+	}
+	return cookie.Value, true
+}
+
+func (ct CookieTransport) Emit(w http.ResponseWriter, value string, o CookieOptions) {
+	http.SetCookie(w, newCookie(ct.Name, value, o))
+}
+
+func newCookie(name, value string, o CookieOptions) *http.Cookie {
+	cookie := &http.Cookie{
+		Name:        name,
+		Value:       value,
+		Path:        o.Path,
+		Domain:      o.Domain,
+		Expires:     o.Expires,
+		Secure:      o.Secure,
+		HttpOnly:    o.HttpOnly,
+		SameSite:    o.SameSite,
+		Partitioned: o.Partitioned,
+	}
+	if 0 < o.MaxAge {
+		cookie.MaxAge = int(o.MaxAge / time.Second)
+	} else if o.MaxAge < 0 {
+		cookie.MaxAge = -1
+	}
+	return cookie
+}
+
+func (ct CookieTransport) Validate(o CookieOptions) error {
+	return validateCookie(ct.Name, o)
+}
+
+// HeaderTransport reads the id from Header, optionally behind an
+// authorization Scheme such as "Bearer", and answers with ResponseHeader,
+// which defaults to Header.
+type HeaderTransport struct {
+	Header         string
+	Scheme         string
+	ResponseHeader string
+}
+
+func (ht HeaderTransport) Extract(r *http.Request) (string, bool) {
+	v := r.Header.Get(ht.Header)
+	if ht.Scheme != "" {
+		i := strings.IndexByte(v, ' ')
+		if i < 0 || !strings.EqualFold(v[:i], ht.Scheme) {
+			return "", false
+		}
+		v = strings.TrimSpace(v[i+1:])
+	}
+	return v, v != ""
+}
+
+func (ht HeaderTransport) Emit(w http.ResponseWriter, value string, o CookieOptions) {
+	name := ht.ResponseHeader
+	if name == "" {
+		name = ht.Header
+	}
+	if o.MaxAge < 0 {
+		value = ""
+	}
+	w.Header().Set(name, value)
+}
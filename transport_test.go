@@ -0,0 +1,129 @@
+package sessions_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/mix3/fever-sessions"
+	"github.com/mix3/fever/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHeaderTransport(t *testing.T) {
+	ht := sessions.HeaderTransport{Header: "Authorization", Scheme: "Bearer", ResponseHeader: "X-Session-Token"}
+	for value, expected := range map[string]string{
+		"":             "",
+		"Bearer":       "",
+		"Basic abc":    "",
+		"Bearer abc":   "abc",
+		"bearer  abc ": "abc",
+	} {
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.Header.Set("Authorization", value)
+		v, ok := ht.Extract(r)
+		assert.Equal(t, expected, v, value)
+		assert.Equal(t, expected != "", ok, value)
+	}
+	w := httptest.NewRecorder()
+	ht.Emit(w, "abc", sessions.CookieOptions{})
+	assert.Equal(t, "abc", w.Header().Get("X-Session-Token"))
+	ht.Emit(w, "abc", sessions.CookieOptions{MaxAge: -1})
+	assert.Equal(t, []string{""}, w.Header()["X-Session-Token"])
+}
+
+func TestTransports(t *testing.T) {
+	store := sessions.NewMemoryStore()
+	defer func() {
+		err := store.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+	ss := sessions.New(store, "myapp_session")
+	ss.Transports = []sessions.Transport{
+		sessions.HeaderTransport{Header: "Authorization", Scheme: "Bearer", ResponseHeader: "X-Session-Token"},
+		sessions.HeaderTransport{Header: "X-Session-Token"},
+		sessions.CookieTransport{Name: "myapp_session"},
+	}
+	m := mux.New()
+	m.Use(ss.Middleware)
+	m.Get("/").ThenFunc(func(c context.Context, w http.ResponseWriter, r *http.Request) {
+		s := sessions.Session(c)
+		v := 1
+		if s.Exists("counter") {
+			v = s.Get("counter").(int) + 1
+		}
+		s.Set("counter", v)
+		fmt.Fprintf(w, "counter=>%d", v)
+	})
+	m.Get("/login").ThenFunc(func(c context.Context, w http.ResponseWriter, r *http.Request) {
+		sessions.Session(c).ChangeId(true)
+		fmt.Fprintf(w, "LOGIN")
+	})
+	ts := httptest.NewServer(m)
+	defer ts.Close()
+	get := func(path string, header http.Header) (string, http.Header) {
+		req, _ := http.NewRequest("GET", ts.URL+path, nil)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		return string(body), res.Header
+	}
+	re := regexp.MustCompile("myapp_session=([a-f0-9]{40})")
+	var token string
+	{
+		body, header := get("/", nil)
+		assert.Equal(t, "counter=>1", body)
+		token = header.Get("X-Session-Token")
+		assert.Regexp(t, "^[a-f0-9]{40}$", token)
+		if ok := assert.Len(t, header["Set-Cookie"], 1); ok {
+			assert.Equal(t, token, re.FindStringSubmatch(header["Set-Cookie"][0])[1])
+		}
+	}
+	{
+		body, header := get("/", http.Header{"Authorization": {"Bearer " + token}})
+		assert.Equal(t, "counter=>2", body)
+		assert.Equal(t, "", header.Get("X-Session-Token"))
+	}
+	{
+		body, _ := get("/", http.Header{"X-Session-Token": {token}})
+		assert.Equal(t, "counter=>3", body)
+	}
+	{
+		body, _ := get("/", http.Header{"Cookie": {"myapp_session=" + token}})
+		assert.Equal(t, "counter=>4", body)
+	}
+	{
+		// unknown and malformed values fall through to the next transport
+		body, _ := get("/", http.Header{
+			"Authorization":   {"Bearer " + strings.Repeat("0", 40)},
+			"X-Session-Token": {"garbage"},
+			"Cookie":          {"myapp_session=" + token},
+		})
+		assert.Equal(t, "counter=>5", body)
+	}
+	{
+		body, header := get("/login", http.Header{"Authorization": {"Bearer " + token}})
+		assert.Equal(t, "LOGIN", body)
+		assert.Len(t, header["Set-Cookie"], 0)
+		assert.NotEqual(t, token, header.Get("X-Session-Token"))
+		token = header.Get("X-Session-Token")
+	}
+	{
+		body, _ := get("/", http.Header{"Authorization": {"Bearer " + token}})
+		assert.Equal(t, "counter=>6", body)
+	}
+}